@@ -11,6 +11,14 @@ pass key objects around.
 In general, the difference is that Goon's API is identical to the datastore API,
 it's just shorter.
 
+Goon uses the google.golang.org/appengine packages, which work with the
+standard library's context.Context on the second generation runtimes. Any
+context derived from an App Engine request context, e.g. with a deadline, can
+be given to FromContext. Contexts from google.golang.org/appengine/v2 are not
+supported: its API calls are routed separately from the v1 packages, so the
+request context must come from google.golang.org/appengine, e.g. from
+appengine.NewContext or NewGoon.
+
 Keys in Goon are stored in the structs themselves. Below is an example struct
 with a field to specify the id (see the Key Specifications section below for
 full documentation).
@@ -61,6 +69,33 @@ An example with both parent and kind:
 		Data   []byte
 	}
 
+Optimistic Concurrency
+
+If a field of type int64 has a struct tag named goon with value "version",
+Put and PutMulti only save the entity if the stored entity has the same
+version, and increment the version when they do. Otherwise they return an
+*ErrVersionConflict. A new entity is considered to be stored with version 0.
+Outside of a transaction, the check and the save run in a cross-group
+transaction of their own.
+
+	type Account struct {
+		Id      int64 `datastore:"-" goon:"id"`
+		Version int64 `goon:"version"`
+		Balance int64
+	}
+
+Timestamps
+
+Fields of type time.Time with a goon struct tag of "created" or "updated" are
+set by Put and PutMulti: the updated field on every save, and the created field
+when the entity is new, i.e. its key is incomplete or the field is zero.
+
+	type Post struct {
+		Id        int64     `datastore:"-" goon:"id"`
+		CreatedAt time.Time `goon:"created"`
+		UpdatedAt time.Time `goon:"updated"`
+	}
+
 Features
 
 Datastore interaction with: Get, GetMulti, Put, PutMulti, Delete, DeleteMulti, Queries.
@@ -94,8 +94,11 @@ func (sr *serializationReader) ReadByte() (c byte, err error) {
 }
 
 const (
-	serializationStateEmpty  = 0x00
-	serializationStateNormal = 0x01
+	serializationStateEmpty             = 0x00
+	serializationStateNormal            = 0x01
+	serializationStatePropertyLoadSaver = 0x02
+	serializationStateCodec             = 0x03 // Encoded by Goon.Codec
+	serializationStateCompressed        = 0x04 // Followed by another serialization state, compressed with flate
 )
 
 var (
@@ -110,6 +113,12 @@ var (
 	seBoot                    = seBootstrap{v01: &datastore.Key{}}
 	seBootBytes               []byte
 	seBootBytesLock           sync.RWMutex
+	taggedFields              = make(map[taggedFieldKey]int)
+	taggedFieldsLock          sync.RWMutex
+	gobTypes                  = make(map[reflect.Type]error) // RegisterGobType results
+	gobTypesLock              sync.Mutex
+	interfaceFields           = make(map[reflect.Type]bool) // whether registerInterfaceFields has to walk a type
+	interfaceFieldsLock       sync.RWMutex
 )
 
 func init() {
@@ -132,6 +141,28 @@ func init() {
 	//       * The usage is removed during a code update
 	//    b) Register a same type as us, but in an inconsistent order between multiple executions
 	freeSerializationDecoder(getSerializationDecoder([]byte{}))
+
+	// The non-basic types that can be held in datastore.Property.Value,
+	// so that PropertyLoadSaver entities can be serialized.
+	gob.Register(&datastore.Key{})
+	gob.Register(time.Time{})
+	gob.Register(appengine.BlobKey(""))
+	gob.Register(appengine.GeoPoint{})
+	gob.Register(datastore.ByteString(nil))
+	gob.Register(&datastore.Entity{})
+}
+
+// propertyLoadSaver returns v as a datastore.PropertyLoadSaver, if v or a pointer to v implements it.
+func propertyLoadSaver(v reflect.Value) (datastore.PropertyLoadSaver, bool) {
+	if pls, ok := v.Interface().(datastore.PropertyLoadSaver); ok {
+		return pls, true
+	}
+	if v.CanAddr() {
+		if pls, ok := v.Addr().Interface().(datastore.PropertyLoadSaver); ok {
+			return pls, true
+		}
+	}
+	return nil, false
 }
 
 // getFieldInfoAndMetadata returns metadata about a struct. Its main purpose is to cut down
@@ -389,6 +420,20 @@ func serializeStruct(src interface{}) ([]byte, error) {
 		return nil, fmt.Errorf("goon: Expected struct, got instead: %v", k)
 	}
 
+	// Entities with custom Save/Load logic are cached as their saved properties,
+	// so that reading them from the cache goes through their Load method.
+	if pls, ok := propertyLoadSaver(reflect.ValueOf(src)); ok {
+		props, err := pls.Save()
+		if err != nil {
+			return nil, err
+		}
+		buf := bytes.NewBuffer([]byte{serializationStatePropertyLoadSaver})
+		if err := gob.NewEncoder(buf).Encode(props); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
 	se := getSerializationEncoder()
 	defer freeSerializationEncoder(se)
 	smd := &structMetaData{metaDatas: make([]string, 0, 16)}
@@ -593,6 +638,16 @@ func deserializeStruct(dst interface{}, b []byte) error {
 
 	if header := b[0]; header == serializationStateEmpty {
 		return datastore.ErrNoSuchEntity
+	} else if header == serializationStatePropertyLoadSaver {
+		pls, ok := propertyLoadSaver(reflect.ValueOf(dst))
+		if !ok {
+			return fmt.Errorf("goon: Expected %v to implement datastore.PropertyLoadSaver", t)
+		}
+		var props []datastore.Property
+		if err := gob.NewDecoder(bytes.NewReader(b[1:])).Decode(&props); err != nil {
+			return err
+		}
+		return pls.Load(props)
 	} else if header != serializationStateNormal {
 		return fmt.Errorf("goon: Unrecognized cache header: %v", header)
 	}
@@ -600,11 +655,23 @@ func deserializeStruct(dst interface{}, b []byte) error {
 	smd := deserializeStructMetaData(b[1:])
 	dataPos := 1 + smd.totalLength + len(smd.metaDatas)
 	sd := getSerializationDecoder(b[dataPos:])
-	defer freeSerializationDecoder(sd)
+	var err error
+	defer func() {
+		// A gob decoder is unusable after a decoding error, so give the pool a fresh one instead
+		if err != nil {
+			sd.dec = gob.NewDecoder(sd.sr)
+			bootstrapSerializationDecoder(sd)
+		}
+		freeSerializationDecoder(sd)
+	}()
 	structHistory := make(map[string]map[string]bool, 8)
 	fieldMap, _ := getFieldInfoAndMetadata(t)
 
 	for _, metaData := range smd.metaDatas {
+		if len(metaData) == 0 {
+			err = fmt.Errorf("goon: Empty field metadata")
+			return err
+		}
 		fieldName, slice, zeroValue := metaData, false, false
 		if metaData[0] == '$' {
 			fieldName, slice = metaData[1:], true
@@ -615,10 +682,11 @@ func deserializeStruct(dst interface{}, b []byte) error {
 
 		fi, ok := fieldMap[fieldName]
 		if !ok {
-			return fmt.Errorf("goon: Could not find field %v", fieldName)
+			err = fmt.Errorf("goon: Could not find field %v", fieldName)
+			return err
 		}
 
-		if err := deserializeStructInternal(sd.dec, fi, fieldName, nameParts, slice, zeroValue, structHistory, v, t); err != nil {
+		if err = deserializeStructInternal(sd.dec, fi, fieldName, nameParts, slice, zeroValue, structHistory, v, t); err != nil {
 			return err
 		}
 	}
@@ -687,10 +755,30 @@ func deserializeStructInternal(dec *gob.Decoder, fi *fieldInfo, fieldName string
 	return nil
 }
 
+// KeyProvider is implemented by entities that compute their own key, e.g. a
+// composite string id built from several fields, instead of using the fields
+// tagged goon:"id", goon:"kind" and goon:"parent". GoonKey must return the
+// same key for the same entity every time, based on fields that are stored
+// in the datastore, because loaded entities have no other way to find out
+// their key. Fields with goon tags are still set from the key, if present.
+// Loading by key alone, as GetMap, GetByKeys and the generic Get and GetMulti
+// do, fails for entities whose key GoonKey can't compute from those fields.
+type KeyProvider interface {
+	GoonKey(g *Goon) *datastore.Key
+}
+
 // getStructKey returns the key of the struct based in its reflected or
-// specified kind and id. The second return parameter is true if src has a
-// string id.
+// specified kind and id, or the key from its KeyProvider implementation.
+// The second return parameter is true if src has a string id.
 func (g *Goon) getStructKey(src interface{}) (key *datastore.Key, hasStringId bool, err error) {
+	if kp, ok := src.(KeyProvider); ok {
+		if key = kp.GoonKey(g); key == nil {
+			err = fmt.Errorf("goon: GoonKey returned a nil key for %T", src)
+			return
+		}
+		return key, key.StringID() != "", nil
+	}
+
 	v := reflect.Indirect(reflect.ValueOf(src))
 	t := v.Type()
 	k := t.Kind()
@@ -854,9 +942,166 @@ func (g *Goon) setStructKey(src interface{}, key *datastore.Key) error {
 		}
 	}
 
+	if kp, ok := src.(KeyProvider); ok {
+		// The key can only be set through the fields GoonKey is based on, so
+		// an entity that doesn't already provide the key would be loaded wrongly
+		if pk := kp.GoonKey(g); pk == nil || !pk.Equal(key) {
+			return fmt.Errorf("goon: %T provides the key %v instead of %v", src, pk, key)
+		}
+		return nil
+	}
 	if !idSet {
 		return fmt.Errorf("goon: Could not set id field")
 	}
 
 	return nil
 }
+
+// versionField returns the int64 field of the struct v tagged goon:"version",
+// if it has one. v may also be a pointer or interface holding the struct.
+func versionField(v reflect.Value) (reflect.Value, bool) {
+	return taggedField(v, "version", func(t reflect.Type) bool { return t.Kind() == reflect.Int64 })
+}
+
+// expiresField returns the time.Time field of the struct v tagged
+// goon:"expires", if it has one. v may also be a pointer or interface holding
+// the struct.
+func expiresField(v reflect.Value) (reflect.Value, bool) {
+	return timestampField(v, "expires")
+}
+
+// timestampField returns the time.Time field of the struct v tagged
+// goon:"<tag>", e.g. goon:"created", if it has one.
+func timestampField(v reflect.Value, tag string) (reflect.Value, bool) {
+	return taggedField(v, tag, func(t reflect.Type) bool { return t == timeType })
+}
+
+type taggedFieldKey struct {
+	t   reflect.Type
+	tag string
+}
+
+// taggedField returns the first field of the struct v tagged goon:"<tag>"
+// whose type is valid. The index of the field is cached per type.
+func taggedField(v reflect.Value, tag string, valid func(reflect.Type) bool) (reflect.Value, bool) {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	v = reflect.Indirect(v)
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	key := taggedFieldKey{v.Type(), tag}
+
+	taggedFieldsLock.RLock()
+	idx, ok := taggedFields[key]
+	taggedFieldsLock.RUnlock()
+	if !ok {
+		idx = -1
+		for i := 0; i < key.t.NumField(); i++ {
+			tf := key.t.Field(i)
+			if strings.Split(tf.Tag.Get("goon"), ",")[0] == tag && valid(tf.Type) {
+				idx = i
+				break
+			}
+		}
+		taggedFieldsLock.Lock()
+		taggedFields[key] = idx
+		taggedFieldsLock.Unlock()
+	}
+	if idx < 0 {
+		return reflect.Value{}, false
+	}
+	return v.Field(idx), true
+}
+
+// RegisterGobType registers the concrete type of v with encoding/gob, like
+// gob.Register. Entities with interface fields can only be stored in memcache
+// with a gob based Codec, such as memcache.Gob, if the concrete types of the
+// values of those fields are registered. Only when Codec is &memcache.Gob
+// does goon register the types of the values it encodes itself; goon can't
+// tell whether any other Codec uses gob, so with a custom gob based Codec
+// every such type must be registered explicitly. Either way, a type must also
+// be registered before a request that didn't encode it can decode it, e.g. in
+// an init function. Registering a type again, even under another name, is
+// harmless, but an error is returned if another type already uses its name.
+func RegisterGobType(v interface{}) error {
+	t := reflect.TypeOf(v)
+	gobTypesLock.Lock()
+	defer gobTypesLock.Unlock()
+	if err, ok := gobTypes[t]; ok {
+		return err
+	}
+	err := registerGob(v)
+	gobTypes[t] = err
+	return err
+}
+
+// registerGob calls gob.Register, turning its panics into errors. A type
+// that was already registered under another name is usable anyway, so that
+// isn't an error.
+func registerGob(v interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if msg, ok := r.(string); ok && strings.Contains(msg, "registering duplicate names") {
+				return
+			}
+			err = fmt.Errorf("goon: Could not register %T with gob - %v", v, r)
+		}
+	}()
+	gob.Register(v)
+	return nil
+}
+
+// registerInterfaceFields registers the concrete types of the values in the
+// interface fields of the struct v, and of the struct fields it contains, with
+// RegisterGobType.
+func registerInterfaceFields(v reflect.Value) error {
+	v = reflect.Indirect(v)
+	if v.Kind() != reflect.Struct || !hasInterfaceFields(v.Type()) {
+		return nil
+	}
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).PkgPath != "" {
+			continue
+		}
+		switch vf := v.Field(i); vf.Kind() {
+		case reflect.Interface:
+			if !vf.IsNil() {
+				if err := RegisterGobType(vf.Elem().Interface()); err != nil {
+					return err
+				}
+				if err := registerInterfaceFields(vf.Elem()); err != nil {
+					return err
+				}
+			}
+		case reflect.Struct:
+			if err := registerInterfaceFields(vf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hasInterfaceFields reports whether the struct type t has exported interface
+// fields, directly or in the struct fields it contains.
+func hasInterfaceFields(t reflect.Type) bool {
+	interfaceFieldsLock.RLock()
+	has, ok := interfaceFields[t]
+	interfaceFieldsLock.RUnlock()
+	if ok {
+		return has
+	}
+	if t != timeType {
+		for i := 0; i < t.NumField() && !has; i++ {
+			if f := t.Field(i); f.PkgPath == "" {
+				has = f.Type.Kind() == reflect.Interface || f.Type.Kind() == reflect.Struct && hasInterfaceFields(f.Type)
+			}
+		}
+	}
+	interfaceFieldsLock.Lock()
+	interfaceFields[t] = has
+	interfaceFieldsLock.Unlock()
+	return has
+}
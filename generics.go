@@ -0,0 +1,66 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+ * Copyright (c) 2012 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"google.golang.org/appengine/datastore"
+)
+
+// The functions in this file are type safe wrappers of the Goon methods of
+// the same name. T must be a struct type that can be used with those methods.
+
+// Get loads the entity for key into a new *T. Otherwise the same as Goon.Get.
+func Get[T any](g *Goon, key *datastore.Key) (*T, error) {
+	dst := new(T)
+	if err := g.setStructKey(dst, key); err != nil {
+		return nil, err
+	}
+	if err := g.Get(dst); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// GetMulti loads the entities for keys into new *Ts. Otherwise the same as
+// Goon.GetMulti: if only some of the entities can't be loaded, all of them
+// are returned together with an appengine.MultiError.
+func GetMulti[T any](g *Goon, keys []*datastore.Key) ([]*T, error) {
+	dst := make([]*T, len(keys))
+	for i, key := range keys {
+		dst[i] = new(T)
+		if err := g.setStructKey(dst[i], key); err != nil {
+			return nil, err
+		}
+	}
+	if err := g.GetMulti(dst); err != nil {
+		return dst, err
+	}
+	return dst, nil
+}
+
+// Put is the same as Goon.Put.
+func Put[T any](g *Goon, src *T) (*datastore.Key, error) {
+	return g.Put(src)
+}
+
+// PutMulti is the same as Goon.PutMulti.
+func PutMulti[T any](g *Goon, src []*T) ([]*datastore.Key, error) {
+	return g.PutMulti(src)
+}
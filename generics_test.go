@@ -0,0 +1,75 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+ * Copyright (c) 2012 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"testing"
+
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestGenerics(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	key, err := Put(g, &HasId{Id: 1, Name: "one"})
+	if err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	keys, err := PutMulti(g, []*HasId{{Id: 2, Name: "two"}, {Name: "incomplete"}})
+	if err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	if keys[1].Incomplete() {
+		t.Errorf("Expected a generated key, got %v", keys[1])
+	}
+
+	for _, flush := range []bool{false, true} {
+		if flush {
+			g.FlushLocalCache()
+			memcache.Flush(c)
+		}
+		hid, err := Get[HasId](g, key)
+		if err != nil {
+			t.Fatalf("Unexpected error on Get - %v", err)
+		}
+		if hid.Id != 1 || hid.Name != "one" {
+			t.Errorf("Expected one, got %+v", hid)
+		}
+
+		hids, err := GetMulti[HasId](g, append(keys, g.NewKey(&HasId{}, "", 3, nil)))
+		if !NotFound(err, 2) || NotFound(err, 0) || NotFound(err, 1) {
+			t.Fatalf("Expected only the third entity to be missing, got %v", err)
+		}
+		if hids[0].Name != "two" || hids[1].Name != "incomplete" || hids[1].Id != keys[1].IntID() {
+			t.Errorf("Expected two and incomplete, got %+v, %+v", hids[0], hids[1])
+		}
+	}
+
+	if _, err := Get[HasId](g, g.NewKey(&HasId{}, "", 3, nil)); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Expected ErrNoSuchEntity, got %v", err)
+	}
+}
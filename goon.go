@@ -18,7 +18,12 @@ package goon
 
 import (
 	"bytes"
+	"compress/flate"
+	"container/list"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"path/filepath"
 	"reflect"
@@ -30,8 +35,6 @@ import (
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/memcache"
 
-	"golang.org/x/net/context"
-
 	"google.golang.org/appengine/log"
 )
 
@@ -53,24 +56,153 @@ var (
 	// MemcacheGetTimeout is the amount of time to wait for all memcache Get
 	// requests.
 	MemcacheGetTimeout = time.Millisecond * 10
+	// TestingMaxDelay is the longest random delay injected before RPCs by a
+	// Goon in testing mode. See SetTesting.
+	TestingMaxDelay = time.Millisecond * 20
 )
 
+// localCache is the request memory cache of a Goon. Goons returned by
+// WithTimeout share it with the Goon they were derived from.
+type localCache struct {
+	cache      map[string]interface{}
+	cacheLock  sync.RWMutex // protect the cache from concurrent goroutines to speed up RPC access
+	cacheLimit int
+	cacheLRU   *list.List               // keys of cache, most recently used first; nil if cacheLimit is 0
+	cacheElems map[string]*list.Element // cacheLRU elements by key
+}
+
+// transaction holds the changes made in a transaction, which are applied to
+// the caches once it is committed. Goons returned by WithTimeout within the
+// transaction share it.
+type transaction struct {
+	toSet      map[string]interface{}
+	toDelete   map[string]bool
+	toDeleteMC map[string]bool
+	rollback   []func() // undoes changes to the saved entities if the transaction fails
+	afterPut   []func() // AfterPut calls to make once the transaction is committed
+}
+
 // Goon holds the app engine context and the request memory cache.
 type Goon struct {
-	Context       context.Context
-	cache         map[string]interface{}
-	cacheLock     sync.RWMutex // protect the cache from concurrent goroutines to speed up RPC access
+	Context context.Context
+	*localCache
 	inTransaction bool
-	toSet         map[string]interface{}
-	toDelete      map[string]bool
-	toDeleteMC    map[string]bool
+	testing       bool
+	stats         Stats                                         // protected by cacheLock
+	*transaction                                                // nil outside of transactions; protected by cacheLock
+	sleep         func(time.Duration)                           // time.Sleep, replaced in tests
+	infof         func(context.Context, string, ...interface{}) // log.Infof, replaced in tests
 	// KindNameResolver is used to determine what Kind to give an Entity.
-	// Defaults to DefaultKindName
+	// Defaults to DefaultKindName. A custom resolver can, for example, map a
+	// renamed type back to its original kind. Entities with a goon:"kind"
+	// field use that field instead.
 	KindNameResolver KindNameResolver
+	// ContextDecorator, if set, is called before every datastore and memcache
+	// RPC with the name of the operation, e.g. "datastore.GetMulti". The
+	// returned context is used for that RPC only.
+	ContextDecorator func(c context.Context, op string) context.Context
+	// MemcacheExpiration is the expiration time of the items goon stores in
+	// memcache. Zero, the default, means the items don't expire. Entities with
+	// a time.Time field tagged goon:"expires" expire from memcache no later
+	// than that time, and aren't stored in memcache once it has passed.
+	MemcacheExpiration time.Duration
+	// DisableMemcache turns off all memcache usage. The local memory cache
+	// and the datastore are used as usual.
+	DisableMemcache bool
+	// CachePrefix is prepended to the keys of all the items goon stores in
+	// memcache. Changing it, e.g. from "v1:" to "v2:" after an incompatible
+	// change of an entity's struct, makes goon ignore all the items stored
+	// with the old prefix, without flushing memcache.
+	CachePrefix string
+	// CacheLayer, if set, is consulted by Get and GetMulti after the local
+	// memory cache and before memcache. Everything goon stores in or deletes
+	// from memcache is stored in or deleted from the CacheLayer too, with the
+	// same expiration. Other instances' CacheLayers aren't invalidated; see
+	// CacheLayer. It isn't used if DisableMemcache is set.
+	CacheLayer CacheLayer
+	// CacheMisses makes the local memory cache also remember keys that don't
+	// exist, so that repeated Gets of a missing entity don't issue any RPCs.
+	// Put and Delete of the key clear the cached miss.
+	CacheMisses bool
+	// RetryAttempts is the maximum number of times a datastore Get, Put or
+	// Delete RPC is attempted when it fails with a transient error, such as a
+	// timeout. Zero or one means the RPC is never retried. RPCs made within a
+	// transaction are never retried; RunInTransaction retries the whole
+	// transaction instead. Puts of entities with incomplete keys aren't
+	// retried either, as they may have been saved despite the error.
+	RetryAttempts int
+	// RetryBackoff is the delay before the first retry. It doubles with each
+	// further attempt, and the actual delay is randomly jittered.
+	RetryBackoff time.Duration
+	// Codec, if set, is used to encode entities stored in memcache instead of
+	// goon's own serialization, e.g. memcache.JSON. Entries written with a
+	// different codec are treated as cache misses. Unlike goon's own
+	// serialization, which stores exactly the properties the datastore would,
+	// a codec also caches fields tagged `datastore:"-"`, unless it skips
+	// them itself, like memcache.JSON does for `json:"-"`. The concrete types
+	// in interface fields are registered with gob automatically only for
+	// &memcache.Gob; see RegisterGobType.
+	Codec *memcache.Codec
+	// GetMultiLimit, PutMultiLimit and DeleteMultiLimit are the maximum number
+	// of entities sent to the datastore in a single RPC. Larger requests are
+	// split into concurrent batches, which are all started at once, so only a
+	// Context that is already done when the request is made stops them early.
+	// FromContext sets them to the datastore's limits; smaller values help
+	// with very large entities.
+	GetMultiLimit    int
+	PutMultiLimit    int
+	DeleteMultiLimit int
+	// ErrorHandler, if set, is called with every error goon encounters,
+	// including the ones it recovers from, such as memcache failures. It
+	// replaces the default logging, so LogErrors has no effect on it.
+	ErrorHandler func(c context.Context, err error)
+	// WriteThrough makes Put store the saved entities in memcache, instead of
+	// deleting their memcache entries, so that the next Get doesn't need the
+	// datastore. Memcache is still updated only after the datastore, but a
+	// concurrent request that read the old entity before the Put can still
+	// overwrite the memcache entry with it. Only enable this for entities that
+	// aren't written concurrently, or that tolerate briefly stale reads.
+	WriteThrough bool
+	// IgnoreFieldMismatch makes Get and GetMulti treat entities with stored
+	// properties that the struct doesn't have, e.g. after a field was removed,
+	// as successfully loaded, instead of returning *datastore.ErrFieldMismatch.
+	// The other fields are loaded and cached as usual.
+	IgnoreFieldMismatch bool
+	// CompressThreshold, if positive, is the size in bytes above which the
+	// entities stored in memcache are compressed. Compression lets large
+	// entities fit within memcache's item size limit of 1MB. Compressed items
+	// are read regardless of this setting.
+	CompressThreshold int
+	// NilMissing makes GetMulti set the elements of a []*S or []I dst to nil
+	// if there is no entity for them. The returned appengine.MultiError still
+	// holds datastore.ErrNoSuchEntity at their indices.
+	NilMissing bool
+	// DryRun makes Put, PutMulti, Delete and DeleteMulti only log the keys
+	// they would write, and return successfully without changing the
+	// datastore, memcache or the local cache. Reads work as usual. This helps
+	// to preview what a batch job, e.g. a Migrate, would do.
+	DryRun bool
+	// BeforePut, if set, is called with every entity that Put and PutMulti
+	// are about to save, in order. The key is incomplete for new entities
+	// whose key is generated by the datastore. BeforePut may be called more
+	// than once for the same entity, as transactions are retried, and entities
+	// with a goon:"version" field are saved in a transaction.
+	BeforePut func(key *datastore.Key, src interface{})
+	// AfterPut, if set, is called with every entity that Put and PutMulti
+	// saved successfully, in order, once all of them have been saved. In a
+	// transaction, it is called once the transaction has been committed, and
+	// not at all if it fails.
+	AfterPut func(key *datastore.Key, src interface{})
+	// AfterGet, if set, is called with every entity that Get and GetMulti
+	// load from the datastore, before it is cached. Entities served from the
+	// caches were already passed to AfterGet when they were loaded. AfterGet
+	// may be called concurrently for entities of large GetMulti calls.
+	AfterGet func(key *datastore.Key, dst interface{})
 }
 
 func memkey(k *datastore.Key) string {
-	// Versioning, so that incompatible changes to the cache system won't cause problems
+	// Versioning, so that incompatible changes to the cache system won't cause problems.
+	// The encoded key includes its namespace, so keys from different namespaces never collide.
 	return "g2:" + k.Encode()
 }
 
@@ -84,12 +216,132 @@ func NewGoon(r *http.Request) *Goon {
 func FromContext(c context.Context) *Goon {
 	return &Goon{
 		Context:          c,
-		cache:            make(map[string]interface{}),
+		localCache:       &localCache{cache: make(map[string]interface{})},
+		sleep:            time.Sleep,
+		infof:            log.Infof,
 		KindNameResolver: DefaultKindName,
+		GetMultiLimit:    getMultiLimit,
+		PutMultiLimit:    putMultiLimit,
+		DeleteMultiLimit: deleteMultiLimit,
+	}
+}
+
+// batchLimit returns limit, or def if limit isn't a usable batch size.
+func batchLimit(limit, def int) int {
+	if limit <= 0 {
+		return def
+	}
+	return limit
+}
+
+// SetTesting turns testing mode on or off. In testing mode every datastore
+// and memcache RPC is preceded by a random delay of up to TestingMaxDelay.
+// Simulating slow RPCs like this helps to reproduce race conditions between
+// concurrent requests, such as two requests updating the same entity while
+// another one repopulates memcache with it.
+func (g *Goon) SetTesting(testing bool) {
+	g.testing = testing
+}
+
+// fakeDelay sleeps for a random time if g is in testing mode. It is called
+// right before each RPC.
+func (g *Goon) fakeDelay() {
+	if g.testing && TestingMaxDelay > 0 {
+		g.sleep(time.Duration(rand.Int63n(int64(TestingMaxDelay))))
+	}
+}
+
+// derive returns a new Goon for the context c, with the same local cache,
+// transaction and settings as g.
+func (g *Goon) derive(c context.Context) *Goon {
+	return &Goon{
+		Context:             c,
+		localCache:          g.localCache,
+		inTransaction:       g.inTransaction,
+		transaction:         g.transaction,
+		testing:             g.testing,
+		sleep:               g.sleep,
+		infof:               g.infof,
+		KindNameResolver:    g.KindNameResolver,
+		ContextDecorator:    g.ContextDecorator,
+		MemcacheExpiration:  g.MemcacheExpiration,
+		DisableMemcache:     g.DisableMemcache,
+		CachePrefix:         g.CachePrefix,
+		CacheLayer:          g.CacheLayer,
+		CacheMisses:         g.CacheMisses,
+		RetryAttempts:       g.RetryAttempts,
+		RetryBackoff:        g.RetryBackoff,
+		Codec:               g.Codec,
+		GetMultiLimit:       g.GetMultiLimit,
+		PutMultiLimit:       g.PutMultiLimit,
+		DeleteMultiLimit:    g.DeleteMultiLimit,
+		ErrorHandler:        g.ErrorHandler,
+		WriteThrough:        g.WriteThrough,
+		IgnoreFieldMismatch: g.IgnoreFieldMismatch,
+		CompressThreshold:   g.CompressThreshold,
+		NilMissing:          g.NilMissing,
+		DryRun:              g.DryRun,
+		BeforePut:           g.BeforePut,
+		AfterPut:            g.AfterPut,
+		AfterGet:            g.AfterGet,
+	}
+}
+
+// WithTimeout returns a Goon with the same settings as g, whose RPCs fail
+// once the duration d has passed, instead of running until the request
+// deadline. The returned Goon shares the local cache of g, and is part of the
+// transaction of g, if any. The cancel function releases the resources of the
+// timeout, and should be called once the returned Goon is no longer used.
+func (g *Goon) WithTimeout(d time.Duration) (*Goon, context.CancelFunc) {
+	c, cancel := context.WithTimeout(g.Context, d)
+	return g.derive(c), cancel
+}
+
+// rpcContext returns the context to use for the RPC op.
+func (g *Goon) rpcContext(op string) context.Context {
+	if g.ContextDecorator == nil {
+		return g.Context
+	}
+	return g.ContextDecorator(g.Context, op)
+}
+
+// retry calls f with the context for op until it succeeds, fails with an
+// error that isn't transient, or g.RetryAttempts is reached. It gives up early
+// if g.Context is done while waiting between attempts.
+func (g *Goon) retry(op string, f func(c context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		g.fakeDelay()
+		err := f(g.rpcContext(op))
+		if err == nil || g.inTransaction || attempt >= g.RetryAttempts || !transientError(err) {
+			return err
+		}
+		// jitter the delay to between half and all of the backoff
+		d := g.RetryBackoff << uint(attempt-1)
+		if d > 0 {
+			d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-g.Context.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
 	}
 }
 
+// transientError reports whether err is worth retrying. Per-entity errors,
+// such as datastore.ErrNoSuchEntity or *datastore.ErrFieldMismatch, are
+// returned in an appengine.MultiError and are never transient.
+func transientError(err error) bool {
+	return appengine.IsTimeoutError(err) || err == datastore.ErrConcurrentTransaction
+}
+
 func (g *Goon) error(err error) {
+	if g.ErrorHandler != nil {
+		g.ErrorHandler(g.Context, err)
+		return
+	}
 	if !LogErrors {
 		return
 	}
@@ -116,13 +368,13 @@ func (g *Goon) extractKeys(src interface{}, putRequest bool) ([]*datastore.Key,
 
 	keys := make([]*datastore.Key, l)
 	for i := 0; i < l; i++ {
-		vi := v.Index(i)
-		key, hasStringId, err := g.getStructKey(vi.Interface())
+		vi := elemInterface(v.Index(i))
+		key, hasStringId, err := g.getStructKey(vi)
 		if err != nil {
 			return nil, err
 		}
 		if !putRequest && key.Incomplete() {
-			return nil, fmt.Errorf("goon: cannot find a key for struct - %v", vi.Interface())
+			return nil, fmt.Errorf("goon: cannot find a key for struct - %v", vi)
 		} else if putRequest && key.Incomplete() && hasStringId {
 			return nil, fmt.Errorf("goon: empty string id on put")
 		}
@@ -148,57 +400,129 @@ func (g *Goon) Kind(src interface{}) string {
 	return ""
 }
 
+// NewKey returns a key with src's kind and the given ids and parent, without
+// needing a struct populated with them. src may be a zero value, e.g.
+// g.NewKey(&User{}, "", 5, nil). nil is returned if src's kind can't be
+// determined.
+func (g *Goon) NewKey(src interface{}, stringID string, intID int64, parent *datastore.Key) *datastore.Key {
+	key, err := g.KeyError(src)
+	if err != nil {
+		return nil
+	}
+	return datastore.NewKey(g.Context, key.Kind(), stringID, intID, parent)
+}
+
 // KeyError returns the key of src based on its properties.
 func (g *Goon) KeyError(src interface{}) (*datastore.Key, error) {
 	key, _, err := g.getStructKey(src)
 	return key, err
 }
 
+// AllocateIDs returns n complete keys of the given kind and parent, whose IDs
+// will never be assigned automatically by the datastore. This lets entities
+// that reference each other be given keys before they are saved.
+//
+// Otherwise similar to appengine/datastore.AllocateIDs.
+func (g *Goon) AllocateIDs(kind string, parent *datastore.Key, n int) ([]*datastore.Key, error) {
+	g.fakeDelay()
+	low, high, err := datastore.AllocateIDs(g.rpcContext("datastore.AllocateIDs"), kind, parent, n)
+	if err != nil {
+		g.error(err)
+		return nil, err
+	}
+	keys := make([]*datastore.Key, 0, n)
+	for id := low; id < high; id++ {
+		keys = append(keys, datastore.NewKey(g.Context, kind, "", id, parent))
+	}
+	return keys, nil
+}
+
 // RunInTransaction runs f in a transaction. It calls f with a transaction
 // context tg that f should use for all App Engine operations. Neither cache nor
-// memcache are used or set during a transaction.
+// memcache are used or set during a transaction, but entities put or deleted
+// earlier in the transaction are read back from its pending changes.
 //
 // Otherwise similar to appengine/datastore.RunInTransaction:
 // https://developers.google.com/appengine/docs/go/datastore/reference#RunInTransaction
 func (g *Goon) RunInTransaction(f func(tg *Goon) error, opts *datastore.TransactionOptions) error {
 	var ng *Goon
-	err := datastore.RunInTransaction(g.Context, func(tc context.Context) error {
-		ng = &Goon{
-			Context:          tc,
-			inTransaction:    true,
-			toSet:            make(map[string]interface{}),
-			toDelete:         make(map[string]bool),
-			toDeleteMC:       make(map[string]bool),
-			KindNameResolver: g.KindNameResolver,
+	rollback := func() {
+		if ng == nil {
+			return
+		}
+		for i := len(ng.rollback) - 1; i >= 0; i-- {
+			ng.rollback[i]()
+		}
+		ng.rollback = nil
+	}
+	g.fakeDelay()
+	err := datastore.RunInTransaction(g.rpcContext("datastore.RunInTransaction"), func(tc context.Context) error {
+		rollback() // undo the previous attempt
+		ng = g.derive(tc)
+		ng.localCache = &localCache{cache: make(map[string]interface{})}
+		g.cacheLock.RLock()
+		limit := g.cacheLimit
+		g.cacheLock.RUnlock()
+		ng.SetLocalCacheLimit(limit)
+		ng.inTransaction = true
+		ng.transaction = &transaction{
+			toSet:      make(map[string]interface{}),
+			toDelete:   make(map[string]bool),
+			toDeleteMC: make(map[string]bool),
 		}
 		return f(ng)
 	}, opts)
 
 	if err == nil {
-		if len(ng.toDeleteMC) > 0 {
+		if len(ng.toDeleteMC) > 0 && !g.DisableMemcache {
 			var memkeys []string
 			for k := range ng.toDeleteMC {
 				memkeys = append(memkeys, k)
 			}
-			memcache.DeleteMulti(g.Context, memkeys)
+			g.deleteMemcache(memkeys)
 		}
 
 		g.cacheLock.Lock()
-		defer g.cacheLock.Unlock()
 		for k, v := range ng.toSet {
 			g.putMemoryKey(k, v)
 		}
 
 		for k := range ng.toDelete {
-			delete(g.cache, k)
+			g.deleteMemoryKey(k)
+		}
+		g.cacheLock.Unlock()
+
+		for _, f := range ng.afterPut {
+			f()
 		}
 	} else {
+		rollback()
 		g.error(err)
 	}
 
 	return err
 }
 
+// RunInTransactionXG is RunInTransaction with a cross-group transaction, so
+// that f may use entities from up to 25 entity groups. Use RunInTransaction
+// to also set the number of attempts.
+func (g *Goon) RunInTransactionXG(f func(tg *Goon) error) error {
+	return g.RunInTransaction(f, &datastore.TransactionOptions{XG: true})
+}
+
+// GetOrInsert atomically loads the entity based on src's key into src, or, if
+// there is no such entity, saves src as it is. src's key must be complete.
+// Either way, src ends up holding the stored entity.
+func (g *Goon) GetOrInsert(src interface{}) error {
+	return g.RunInTransaction(func(tg *Goon) error {
+		err := tg.Get(src)
+		if err == datastore.ErrNoSuchEntity {
+			_, err = tg.Put(src)
+		}
+		return err
+	}, nil)
+}
+
 // Put saves the entity src into the datastore based on src's key k. If k
 // is an incomplete key, the returned key will be a unique key generated by
 // the datastore.
@@ -213,6 +537,7 @@ func (g *Goon) Put(src interface{}) (*datastore.Key, error) {
 	return ks[0], nil
 }
 
+// putMultiLimit is the default PutMultiLimit.
 const putMultiLimit = 500
 
 // PutMulti is a batch version of Put.
@@ -224,6 +549,27 @@ func (g *Goon) PutMulti(src interface{}) ([]*datastore.Key, error) {
 	if err != nil {
 		return nil, err
 	}
+	if g.DryRun {
+		g.infof(g.Context, "goon: dry run, not putting %d entities: %v", len(keys), keys)
+		return keys, nil
+	}
+
+	v := reflect.Indirect(reflect.ValueOf(src))
+	versions := entityVersions(v)
+	if versions != nil {
+		if !g.inTransaction {
+			return g.putVersioned(v, keys)
+		}
+		if err := g.checkVersions(v, keys, versions); err != nil {
+			return nil, err
+		}
+	}
+	setTimestamps(v, keys)
+	if g.BeforePut != nil {
+		for i, key := range keys {
+			g.BeforePut(key, elemInterface(v.Index(i)))
+		}
+	}
 
 	var memkeys []string
 	for _, key := range keys {
@@ -239,50 +585,87 @@ func (g *Goon) PutMulti(src interface{}) ([]*datastore.Key, error) {
 		for _, mk := range memkeys {
 			g.toDeleteMC[mk] = true
 		}
-	} else {
-		defer memcache.DeleteMulti(g.Context, memkeys)
+	} else if !g.DisableMemcache && !g.WriteThrough {
+		defer g.deleteMemcache(memkeys)
 	}
 
-	v := reflect.Indirect(reflect.ValueOf(src))
-	multiErr, any := make(appengine.MultiError, len(keys)), false
-	goroutines := (len(keys)-1)/putMultiLimit + 1
+	multiErr := make(appengine.MultiError, len(keys))
+	limit := batchLimit(g.PutMultiLimit, putMultiLimit)
+	goroutines := (len(keys)-1)/limit + 1
 	var wg sync.WaitGroup
 	wg.Add(goroutines)
 	for i := 0; i < goroutines; i++ {
 		go func(i int) {
 			defer wg.Done()
-			lo := i * putMultiLimit
-			hi := (i + 1) * putMultiLimit
+			lo := i * limit
+			hi := (i + 1) * limit
 			if hi > len(keys) {
 				hi = len(keys)
 			}
-			rkeys, pmerr := datastore.PutMulti(g.Context, keys[lo:hi], v.Slice(lo, hi).Interface())
+			if err := g.Context.Err(); err != nil {
+				// The request was cancelled or past its deadline before the
+				// batches were started, don't bother
+				for j := lo; j < hi; j++ {
+					multiErr[j] = err
+				}
+				return
+			}
+			var rkeys []*datastore.Key
+			put := func(c context.Context) (err error) {
+				rkeys, err = datastore.PutMulti(c, keys[lo:hi], v.Slice(lo, hi).Interface())
+				return err
+			}
+			incomplete := false
+			for _, key := range keys[lo:hi] {
+				incomplete = incomplete || key.Incomplete()
+			}
+			var pmerr error
+			if incomplete {
+				// A timed out put may have been applied anyway, so retrying it
+				// could store the new entities again, with other ids
+				g.fakeDelay()
+				pmerr = put(g.rpcContext("datastore.PutMulti"))
+			} else {
+				pmerr = g.retry("datastore.PutMulti", put)
+			}
 			if pmerr != nil {
-				any = true // this flag tells PutMulti to return multiErr later
 				merr, ok := pmerr.(appengine.MultiError)
-				if !ok {
+				if ok {
+					copy(multiErr[lo:hi], merr)
+				} else {
 					g.error(pmerr)
 					for j := lo; j < hi; j++ {
 						multiErr[j] = pmerr
 					}
-					return
 				}
-				copy(multiErr[lo:hi], merr)
 			}
 
 			for i, key := range keys[lo:hi] {
 				if multiErr[lo+i] != nil {
-					continue // there was an error writing this value, go to next
+					// The entity may or may not have been written, e.g. on a
+					// timeout, so the cached value can't be trusted anymore
+					if !g.inTransaction && !key.Incomplete() {
+						g.cacheLock.Lock()
+						g.deleteMemoryKey(memkey(key))
+						g.cacheLock.Unlock()
+					}
+					continue
 				}
-				vi := v.Index(lo + i).Interface()
+				rvi := v.Index(lo + i)
+				if rvi.Kind() == reflect.Struct {
+					rvi = rvi.Addr() // so that the generated key can be set
+				}
+				vi := rvi.Interface()
 				if key.Incomplete() {
 					g.setStructKey(vi, rkeys[i])
-					keys[i] = rkeys[i]
+					keys[lo+i] = rkeys[i]
 				}
 				if g.inTransaction {
 					mk := memkey(rkeys[i])
+					g.cacheLock.Lock()
 					delete(g.toDelete, mk)
 					g.toSet[mk] = vi
+					g.cacheLock.Unlock()
 				} else {
 					g.putMemory(vi)
 				}
@@ -290,22 +673,315 @@ func (g *Goon) PutMulti(src interface{}) ([]*datastore.Key, error) {
 		}(i)
 	}
 	wg.Wait()
-	if any {
+	if versions != nil && anyError(multiErr) {
+		// The entities that weren't saved keep their old versions
+		failed := make(map[int]int64)
+		for i, version := range versions {
+			if multiErr[i] != nil {
+				failed[i] = version
+			}
+		}
+		restoreVersions(v, failed)
+	}
+	if g.AfterPut != nil {
+		for i, key := range keys {
+			if multiErr[i] != nil {
+				continue
+			}
+			if g.inTransaction {
+				key, src := key, elemInterface(v.Index(i))
+				g.cacheLock.Lock()
+				g.afterPut = append(g.afterPut, func() { g.AfterPut(key, src) })
+				g.cacheLock.Unlock()
+			} else {
+				g.AfterPut(key, elemInterface(v.Index(i)))
+			}
+		}
+	}
+	if g.WriteThrough && !g.inTransaction && !g.DisableMemcache {
+		g.writeThrough(v, keys, multiErr)
+	}
+	if anyError(multiErr) {
 		return keys, realError(multiErr)
 	}
 	return keys, nil
 }
 
+// setTimestamps sets the time.Time fields tagged goon:"updated" of the
+// entities of v to the current time, and the ones tagged goon:"created" too,
+// if the entity is new, i.e. its key is incomplete or the field is zero. The
+// time is truncated to the datastore's microsecond precision, so that cached
+// entities match stored ones.
+func setTimestamps(v reflect.Value, keys []*datastore.Key) {
+	now := time.Now().Truncate(time.Microsecond)
+	for i, key := range keys {
+		vi := v.Index(i)
+		if f, ok := timestampField(vi, "updated"); ok && f.CanSet() {
+			f.Set(reflect.ValueOf(now))
+		}
+		if f, ok := timestampField(vi, "created"); ok && f.CanSet() && (key.Incomplete() || f.Interface().(time.Time).IsZero()) {
+			f.Set(reflect.ValueOf(now))
+		}
+	}
+}
+
+// elemInterface returns the element vi of a PutMulti src or GetMulti dst as
+// a pointer to a struct.
+func elemInterface(vi reflect.Value) interface{} {
+	if vi.Kind() == reflect.Struct {
+		return vi.Addr().Interface()
+	}
+	return vi.Interface()
+}
+
+// ErrVersionConflict is returned by Put and PutMulti when an entity with a
+// goon:"version" field is saved, but the stored entity has another version.
+type ErrVersionConflict struct {
+	Key           *datastore.Key
+	Version       int64 // The version that was being saved
+	StoredVersion int64 // The version in the datastore
+}
+
+func (e *ErrVersionConflict) Error() string {
+	return fmt.Sprintf("goon: version conflict for %v: saving version %d, but version %d is stored", e.Key, e.Version, e.StoredVersion)
+}
+
+// entityVersions returns the goon:"version" field values of the elements of
+// the slice v by index, or nil if none of them has such a field.
+func entityVersions(v reflect.Value) map[int]int64 {
+	var versions map[int]int64
+	for i := 0; i < v.Len(); i++ {
+		if f, ok := versionField(v.Index(i)); ok {
+			if versions == nil {
+				versions = make(map[int]int64)
+			}
+			versions[i] = f.Int()
+		}
+	}
+	return versions
+}
+
+// maxEntityGroups is the number of entity groups a cross-group transaction
+// may use.
+const maxEntityGroups = 25
+
+// putVersioned runs PutMulti in cross-group transactions, so that the
+// versions can be checked and incremented atomically. The entities are split
+// into transactions of up to maxEntityGroups entity groups each, so with more
+// groups some of the transactions may succeed while others fail; the errors
+// are then returned as an appengine.MultiError. The versions of the entities
+// that weren't saved are restored.
+func (g *Goon) putVersioned(v reflect.Value, keys []*datastore.Key) ([]*datastore.Key, error) {
+	var chunks [][]int
+	chunkOf := make(map[string]int) // entity group root key -> chunk index
+	groups := 0                     // entity groups in the last chunk
+	for i, key := range keys {
+		root := key
+		for root.Parent() != nil {
+			root = root.Parent()
+		}
+		c, ok := -1, false
+		if !root.Incomplete() { // each new root entity is its own entity group
+			c, ok = chunkOf[root.String()]
+		}
+		if !ok {
+			if len(chunks) == 0 || groups == maxEntityGroups {
+				chunks = append(chunks, nil)
+				groups = 0
+			}
+			c = len(chunks) - 1
+			groups++
+			if !root.Incomplete() {
+				chunkOf[root.String()] = c
+			}
+		}
+		chunks[c] = append(chunks[c], i)
+	}
+
+	xg := &datastore.TransactionOptions{XG: true}
+	rkeys := make([]*datastore.Key, len(keys))
+	copy(rkeys, keys) // like PutMulti, return the given keys of the entities that weren't saved
+	multiErr := make(appengine.MultiError, len(keys))
+	var wg sync.WaitGroup
+	wg.Add(len(chunks))
+	for _, chunk := range chunks {
+		go func(chunk []int) {
+			defer wg.Done()
+			part := make([]interface{}, len(chunk))
+			for j, i := range chunk {
+				part[j] = elemInterface(v.Index(i))
+			}
+			var pkeys []*datastore.Key
+			err := g.RunInTransaction(func(tg *Goon) (err error) {
+				pkeys, err = tg.PutMulti(part)
+				return err
+			}, xg)
+			for j, i := range chunk {
+				if merr, ok := err.(appengine.MultiError); ok && merr[j] != nil {
+					multiErr[i] = merr[j]
+				} else if err != nil {
+					// Nothing in the transaction was saved
+					multiErr[i] = err
+				} else {
+					rkeys[i] = pkeys[j]
+				}
+			}
+		}(chunk)
+	}
+	wg.Wait()
+	if anyError(multiErr) {
+		return rkeys, realError(multiErr)
+	}
+	return rkeys, nil
+}
+
+// checkVersions compares the versions of the entities being saved with the
+// stored ones, and increments them if they all match. New entities are
+// considered to be stored with version 0, as are the ones deleted earlier in
+// the transaction; the ones put earlier in it are stored with the version that
+// was put. It must run in a transaction, which restores the versions if it
+// fails.
+func (g *Goon) checkVersions(v reflect.Value, keys []*datastore.Key, versions map[int]int64) error {
+	var ckeys []*datastore.Key
+	var cdst []interface{}
+	var cixs []int
+	for i, version := range versions {
+		if keys[i].Incomplete() {
+			continue
+		}
+		mk := memkey(keys[i])
+		g.cacheLock.RLock()
+		s, put := g.toSet[mk]
+		deleted := g.toDelete[mk]
+		g.cacheLock.RUnlock()
+		if put || deleted {
+			// The datastore doesn't show the changes of the transaction yet
+			var stored int64
+			if put {
+				f, _ := versionField(reflect.ValueOf(s))
+				stored = f.Int()
+			}
+			if stored != version {
+				return &ErrVersionConflict{Key: keys[i], Version: version, StoredVersion: stored}
+			}
+			continue
+		}
+		elem := v.Index(i)
+		if elem.Kind() == reflect.Interface {
+			elem = elem.Elem()
+		}
+		ckeys = append(ckeys, keys[i])
+		cdst = append(cdst, reflect.New(reflect.Indirect(elem).Type()).Interface())
+		cixs = append(cixs, i)
+	}
+	if len(ckeys) > 0 {
+		merr := make(appengine.MultiError, len(ckeys))
+		g.fakeDelay()
+		if err := datastore.GetMulti(g.rpcContext("datastore.GetMulti"), ckeys, cdst); err != nil {
+			var ok bool
+			if merr, ok = err.(appengine.MultiError); !ok {
+				return err
+			}
+		}
+		for j, i := range cixs {
+			var stored int64
+			if merr[j] != datastore.ErrNoSuchEntity {
+				if _, ok := merr[j].(*datastore.ErrFieldMismatch); merr[j] != nil && !ok {
+					return merr[j]
+				}
+				f, _ := versionField(reflect.ValueOf(cdst[j]))
+				stored = f.Int()
+			}
+			if stored != versions[i] {
+				return &ErrVersionConflict{Key: ckeys[j], Version: versions[i], StoredVersion: stored}
+			}
+		}
+	}
+	for i, version := range versions {
+		f, _ := versionField(v.Index(i))
+		f.SetInt(version + 1)
+	}
+	g.cacheLock.Lock()
+	g.rollback = append(g.rollback, func() { restoreVersions(v, versions) })
+	g.cacheLock.Unlock()
+	return nil
+}
+
+// restoreVersions sets the goon:"version" fields of the elements of v back to
+// versions, as returned by entityVersions.
+func restoreVersions(v reflect.Value, versions map[int]int64) {
+	for i, version := range versions {
+		f, _ := versionField(v.Index(i))
+		f.SetInt(version)
+	}
+}
+
+// writeThrough stores the entities of v that were successfully put into
+// memcache, and deletes the memcache entries of the ones that weren't. If
+// memcache can't be updated, the entries of all the entities are deleted.
+func (g *Goon) writeThrough(v reflect.Value, keys []*datastore.Key, multiErr appengine.MultiError) {
+	var srcs []interface{}
+	var srckeys, failed []string
+	for i, key := range keys {
+		if multiErr[i] != nil {
+			if !key.Incomplete() {
+				failed = append(failed, memkey(key))
+			}
+			continue
+		}
+		vi := v.Index(i)
+		if vi.Kind() == reflect.Struct {
+			vi = vi.Addr()
+		}
+		srcs = append(srcs, vi.Interface())
+		srckeys = append(srckeys, memkey(key))
+	}
+	if len(srcs) > 0 {
+		items, expired, payloadSize, err := g.memcacheItems(srcs, bytes.Repeat([]byte{1}, len(srcs)))
+		if err == nil {
+			// Older copies of the expired entities may still be cached
+			failed = append(failed, expired...)
+			g.setCacheLayer(items, nil)
+			err = g.setMemcache(items, payloadSize)
+		}
+		if err != nil {
+			g.error(err)
+			failed = append(failed, srckeys...)
+		}
+	}
+	if len(failed) > 0 {
+		g.deleteMemcache(failed)
+	}
+}
+
 func (g *Goon) putMemoryMulti(src interface{}, exists []byte) {
 	v := reflect.Indirect(reflect.ValueOf(src))
 	for i := 0; i < v.Len(); i++ {
 		if exists[i] == 0 {
+			g.putMemoryMiss(v.Index(i).Interface())
 			continue
 		}
 		g.putMemory(v.Index(i).Interface())
 	}
 }
 
+// noSuchEntity is stored in the local cache for keys that are known not to
+// exist, when CacheMisses is enabled.
+type noSuchEntity struct{}
+
+// putMemoryMiss records in the local cache that src doesn't exist, if
+// CacheMisses is enabled.
+func (g *Goon) putMemoryMiss(src interface{}) {
+	if !g.CacheMisses {
+		return
+	}
+	key, _, _ := g.getStructKey(src)
+	g.cacheLock.Lock()
+	defer g.cacheLock.Unlock()
+	g.cache[memkey(key)] = noSuchEntity{}
+	g.touchMemoryKey(memkey(key))
+}
+
 // cache is already locked
 func (g *Goon) putMemoryKey(key string, src interface{}) {
 	if reflect.ValueOf(src).Kind() == reflect.Ptr { // since it's *struct, store a copy instead
@@ -315,6 +991,64 @@ func (g *Goon) putMemoryKey(key string, src interface{}) {
 	} else {
 		g.cache[key] = src
 	}
+	g.touchMemoryKey(key)
+}
+
+// cache is already locked
+func (g *Goon) deleteMemoryKey(key string) {
+	delete(g.cache, key)
+	if e, ok := g.cacheElems[key]; ok {
+		g.cacheLRU.Remove(e)
+		delete(g.cacheElems, key)
+	}
+}
+
+// touchMemoryKey marks key as the most recently used entry of the local
+// cache, and evicts the least recently used entries beyond the limit set by
+// SetLocalCacheLimit. The cache is already locked.
+func (g *Goon) touchMemoryKey(key string) {
+	if g.cacheLimit <= 0 {
+		return
+	}
+	if _, ok := g.cache[key]; !ok {
+		return // evicted or deleted in the meantime
+	}
+	if e, ok := g.cacheElems[key]; ok {
+		g.cacheLRU.MoveToFront(e)
+	} else {
+		g.cacheElems[key] = g.cacheLRU.PushFront(key)
+	}
+	for g.cacheLRU.Len() > g.cacheLimit {
+		k := g.cacheLRU.Remove(g.cacheLRU.Back()).(string)
+		delete(g.cacheElems, k)
+		delete(g.cache, k)
+	}
+}
+
+// SetLocalCacheLimit limits the local memory cache to n entities. When it is
+// full, the least recently used entities are evicted. Zero, the default,
+// means the cache is unbounded. A limit keeps the memory usage of requests
+// that load very many entities, like scans of a whole kind, in check.
+func (g *Goon) SetLocalCacheLimit(n int) {
+	g.cacheLock.Lock()
+	defer g.cacheLock.Unlock()
+	g.cacheLimit = n
+	if n <= 0 {
+		g.cacheLRU, g.cacheElems = nil, nil
+		return
+	}
+	if g.cacheLRU == nil {
+		g.cacheLRU = list.New()
+		g.cacheElems = make(map[string]*list.Element, len(g.cache))
+		for k := range g.cache {
+			g.touchMemoryKey(k)
+		}
+	}
+	for g.cacheLRU.Len() > n {
+		k := g.cacheLRU.Remove(g.cacheLRU.Back()).(string)
+		delete(g.cacheElems, k)
+		delete(g.cache, k)
+	}
 }
 
 func (g *Goon) putMemory(src interface{}) {
@@ -328,46 +1062,346 @@ func (g *Goon) putMemory(src interface{}) {
 func (g *Goon) FlushLocalCache() {
 	g.cacheLock.Lock()
 	g.cache = make(map[string]interface{})
+	if g.cacheLRU != nil {
+		g.cacheLRU.Init()
+		g.cacheElems = make(map[string]*list.Element)
+	}
 	g.cacheLock.Unlock()
 }
 
-func (g *Goon) putMemcache(srcs []interface{}, exists []byte) error {
-	items := make([]*memcache.Item, len(srcs))
-	payloadSize := 0
-	for i, src := range srcs {
-		toSerialize := src
-		if exists[i] == 0 {
-			toSerialize = nil
+// InLocalCache reports whether the entity for src's key is in the local
+// memory cache, so that a Get wouldn't need memcache or the datastore. This
+// includes entities known not to exist, if CacheMisses is enabled.
+func (g *Goon) InLocalCache(src interface{}) bool {
+	key, _, err := g.getStructKey(src)
+	if err != nil || key.Incomplete() {
+		return false
+	}
+	g.cacheLock.RLock()
+	defer g.cacheLock.RUnlock()
+	_, present := g.cache[memkey(key)]
+	return present
+}
+
+// RefreshLocal replaces the entity for src's key in the local memory cache
+// with a copy of src, without saving it. The local cache always holds copies,
+// so changes to an entity after it was loaded or saved aren't seen by later
+// Gets until they are saved, or until RefreshLocal is called. Memcache and
+// the datastore are left alone. src must be a pointer to a struct with a
+// complete key, otherwise RefreshLocal does nothing.
+func (g *Goon) RefreshLocal(src interface{}) {
+	key, _, err := g.getStructKey(src)
+	if err != nil || key.Incomplete() || reflect.ValueOf(src).Kind() != reflect.Ptr {
+		return
+	}
+	g.putMemory(src)
+}
+
+// ClearCache evicts the entities for keys from the local cache and from
+// memcache, so that the next Get loads them from the datastore. Unlike
+// Delete, the entities themselves are left alone. Use it after an entity was
+// modified without goon, for example by another service.
+func (g *Goon) ClearCache(keys ...*datastore.Key) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	memkeys := make([]string, len(keys))
+	g.cacheLock.Lock()
+	for i, k := range keys {
+		memkeys[i] = memkey(k)
+		g.deleteMemoryKey(memkeys[i])
+	}
+	g.cacheLock.Unlock()
+	if g.DisableMemcache {
+		return nil
+	}
+	return g.deleteMemcache(memkeys)
+}
+
+// memcacheDeleteMultiLimit is the maximum number of keys deleted from
+// memcache in one call.
+const memcacheDeleteMultiLimit = 500
+
+// deleteMemcache deletes memkeys from memcache in batches. Keys that aren't
+// in memcache are not an error. Any other error is reported, and the first
+// one is returned.
+func (g *Goon) deleteMemcache(memkeys []string) error {
+	g.deleteCacheLayer(g.prefixKeys(memkeys))
+	var firstErr error
+	for lo := 0; lo < len(memkeys); lo += memcacheDeleteMultiLimit {
+		hi := lo + memcacheDeleteMultiLimit
+		if hi > len(memkeys) {
+			hi = len(memkeys)
+		}
+		g.fakeDelay()
+		err := memcache.DeleteMulti(g.rpcContext("memcache.DeleteMulti"), g.prefixKeys(memkeys[lo:hi]))
+		if merr, ok := err.(appengine.MultiError); ok {
+			err = nil
+			for _, e := range merr {
+				if e != nil && e != memcache.ErrCacheMiss {
+					err = e
+					break
+				}
+			}
 		}
-		data, err := serializeStruct(toSerialize)
 		if err != nil {
 			g.error(err)
-			return err
+			if firstErr == nil {
+				firstErr = err
+			}
 		}
-		key, _, err := g.getStructKey(src)
-		if err != nil {
-			return err
+	}
+	return firstErr
+}
+
+// serialize encodes src for memcache with g.Codec, or with serializeStruct if
+// there is no codec. A nil src, meaning the entity doesn't exist, is always
+// encoded by serializeStruct. Data larger than g.CompressThreshold is
+// compressed.
+func (g *Goon) serialize(src interface{}) ([]byte, error) {
+	var data []byte
+	var err error
+	if g.Codec == nil || src == nil {
+		data, err = serializeStruct(src)
+	} else {
+		if g.Codec == &memcache.Gob {
+			if err := registerInterfaceFields(reflect.ValueOf(src)); err != nil {
+				return nil, err
+			}
 		}
-		// payloadSize will overflow if we push 2+ gigs on a 32bit machine
-		payloadSize += len(data)
-		items[i] = &memcache.Item{
-			Key:   memkey(key),
-			Value: data,
+		if data, err = g.Codec.Marshal(src); err == nil {
+			data = append([]byte{serializationStateCodec}, data...)
 		}
 	}
-	memcacheTimeout := MemcachePutTimeoutSmall
-	if payloadSize >= MemcachePutTimeoutThreshold {
-		memcacheTimeout = MemcachePutTimeoutLarge
+	if err != nil {
+		return nil, err
 	}
-	errc := make(chan error)
-	go func() {
-		ctx, cancel := context.WithTimeout(g.Context, memcacheTimeout)
-		err := memcache.SetMulti(ctx, items)
-		cancel()
-		errc <- err
-	}()
+	if g.CompressThreshold > 0 && len(data) > g.CompressThreshold {
+		return compress(data)
+	}
+	return data, nil
+}
+
+// deserialize decodes b, as encoded by serialize, into dst.
+func (g *Goon) deserialize(dst interface{}, b []byte) error {
+	if len(b) > 0 && b[0] == serializationStateCompressed {
+		var err error
+		if b, err = decompress(b[1:]); err != nil {
+			return err
+		}
+	}
+	if g.Codec == nil || len(b) == 0 || b[0] == serializationStateEmpty {
+		return deserializeStruct(dst, b)
+	}
+	if b[0] != serializationStateCodec {
+		return fmt.Errorf("goon: Unrecognized cache header: %v", b[0])
+	}
+	return g.Codec.Unmarshal(b[1:], dst)
+}
+
+// compress returns data compressed with flate behind a
+// serializationStateCompressed header, or data itself if compressing it
+// doesn't make it any smaller.
+func compress(data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+	buf.WriteByte(serializationStateCompressed)
+	w, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(data) {
+		return data, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress reverses compress, given the data after the header.
+func decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// deserializeCopy deserializes b into d, a pointer to a struct. It decodes
+// into a copy first, so that a bad value can't leave d half filled.
+func (g *Goon) deserializeCopy(d interface{}, b []byte) error {
+	dv := reflect.Indirect(reflect.ValueOf(d))
+	tmp := reflect.New(dv.Type())
+	tmp.Elem().Set(dv)
+	if err := g.deserialize(tmp.Interface(), b); err != nil {
+		return err
+	}
+	dv.Set(tmp.Elem())
+	return nil
+}
+
+// CacheLayer is a cache shared across requests, e.g. an in-process cache of
+// the instance, that goon consults between its local memory cache and
+// memcache. Keys are the memcache keys, and values are the encoded entities,
+// as goon stores them in memcache. A CacheLayer must be safe for concurrent
+// use.
+//
+// Goon only evicts entities that are changed through it from the CacheLayer
+// of the Goon that changes them. Other instances, with CacheLayers of their
+// own, keep serving the old entities until they expire. Invalidating the
+// CacheLayers of other instances, or bounding how stale they may get, is up
+// to the implementation.
+type CacheLayer interface {
+	// GetFromCache returns the values that are cached for keys. Keys that
+	// aren't cached are left out.
+	GetFromCache(keys []string) map[string][]byte
+	// SetToCache caches the given values until the expiration has passed.
+	// As with memcache, zero means they don't expire, though implementations
+	// shared by several instances should limit that to a maximum age. A nil
+	// value means that the key must be evicted, e.g. because its entity was
+	// changed.
+	SetToCache(items map[string][]byte, expiration time.Duration)
+}
+
+// setCacheLayer stores the memcache items in g.CacheLayer, if there is one,
+// with the same expiration as in memcache, and evicts the local cache keys
+// expired from it.
+func (g *Goon) setCacheLayer(items []*memcache.Item, expired []string) {
+	if g.CacheLayer == nil {
+		return
+	}
+	byExpiration := make(map[time.Duration]map[string][]byte)
+	for _, item := range items {
+		m := byExpiration[item.Expiration]
+		if m == nil {
+			m = make(map[string][]byte)
+			byExpiration[item.Expiration] = m
+		}
+		m[item.Key] = item.Value
+	}
+	for expiration, m := range byExpiration {
+		g.CacheLayer.SetToCache(m, expiration)
+	}
+	g.deleteCacheLayer(g.prefixKeys(expired))
+}
+
+// deleteCacheLayer evicts the memcache keys mckeys from g.CacheLayer, if there
+// is one.
+func (g *Goon) deleteCacheLayer(mckeys []string) {
+	if g.CacheLayer == nil || len(mckeys) == 0 {
+		return
+	}
+	m := make(map[string][]byte, len(mckeys))
+	for _, k := range mckeys {
+		m[k] = nil
+	}
+	g.CacheLayer.SetToCache(m, 0)
+}
+
+// prefixKeys returns the memcache keys for the local cache keys memkeys,
+// prefixed with g.CachePrefix.
+func (g *Goon) prefixKeys(memkeys []string) []string {
+	if g.CachePrefix == "" {
+		return memkeys
+	}
+	prefixed := make([]string, len(memkeys))
+	for i, m := range memkeys {
+		prefixed[i] = g.CachePrefix + m
+	}
+	return prefixed
+}
+
+// getMemcache gets the items for the local cache keys memkeys from memcache.
+// The returned items are mapped by the keys in memkeys, without the
+// CachePrefix.
+func (g *Goon) getMemcache(c context.Context, memkeys []string) (map[string]*memcache.Item, error) {
+	items, err := memcache.GetMulti(c, g.prefixKeys(memkeys))
+	if g.CachePrefix == "" || items == nil {
+		return items, err
+	}
+	unprefixed := make(map[string]*memcache.Item, len(items))
+	for k, item := range items {
+		unprefixed[k[len(g.CachePrefix):]] = item
+	}
+	return unprefixed, err
+}
+
+// memcacheItems serializes srcs into memcache items. It also returns the total
+// size of the serialized data. Entities with a goon:"expires" field expire
+// from memcache when they do. Already expired ones are left out, and their
+// local cache keys are returned as expired, so that any older cached copies of
+// them can be deleted.
+func (g *Goon) memcacheItems(srcs []interface{}, exists []byte) (items []*memcache.Item, expired []string, payloadSize int, err error) {
+	items = make([]*memcache.Item, 0, len(srcs))
+	for i, src := range srcs {
+		key, _, err := g.getStructKey(src)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		expiration := g.MemcacheExpiration
+		toSerialize := src
+		if exists[i] == 0 {
+			toSerialize = nil
+		} else if f, ok := expiresField(reflect.ValueOf(src)); ok && !f.Interface().(time.Time).IsZero() {
+			left := time.Until(f.Interface().(time.Time))
+			if left <= 0 {
+				expired = append(expired, memkey(key))
+				continue
+			}
+			if expiration == 0 || left < expiration {
+				expiration = left
+			}
+		}
+		data, err := g.serialize(toSerialize)
+		if err != nil {
+			g.error(err)
+			return nil, nil, 0, err
+		}
+		// payloadSize will overflow if we push 2+ gigs on a 32bit machine
+		payloadSize += len(data)
+		items = append(items, &memcache.Item{
+			Key:        g.CachePrefix + memkey(key),
+			Value:      data,
+			Expiration: expiration,
+		})
+	}
+	return items, expired, payloadSize, nil
+}
+
+// setMemcache stores items in memcache, waiting longer for them if their
+// payloadSize is large. Failures are counted in the Stats, but not reported.
+func (g *Goon) setMemcache(items []*memcache.Item, payloadSize int) error {
+	memcacheTimeout := MemcachePutTimeoutSmall
+	if payloadSize >= MemcachePutTimeoutThreshold {
+		memcacheTimeout = MemcachePutTimeoutLarge
+	}
+	g.fakeDelay()
+	ctx, cancel := context.WithTimeout(g.rpcContext("memcache.SetMulti"), memcacheTimeout)
+	err := memcache.SetMulti(ctx, items)
+	cancel()
+	if err != nil {
+		g.addStats(Stats{MemcachePutErrors: 1})
+	}
+	return err
+}
+
+func (g *Goon) putMemcache(srcs []interface{}, exists []byte) error {
+	if g.DisableMemcache {
+		g.putMemoryMulti(srcs, exists)
+		return nil
+	}
+	items, expired, payloadSize, err := g.memcacheItems(srcs, exists)
+	if err != nil {
+		return err
+	}
+	g.setCacheLayer(items, expired)
+	errc := make(chan error)
+	go func() {
+		errc <- g.setMemcache(items, payloadSize)
+	}()
 	g.putMemoryMulti(srcs, exists)
-	err := <-errc
+	err = <-errc
 	if appengine.IsTimeoutError(err) {
 		g.timeoutError(err)
 		err = nil
@@ -377,6 +1411,63 @@ func (g *Goon) putMemcache(srcs []interface{}, exists []byte) error {
 	return err
 }
 
+// WarmCache stores src in the local cache and in memcache as if it had just
+// been loaded from the datastore, without writing it to the datastore.
+// Subsequent Gets of the same keys are served from the caches. src must be a
+// pointer to a struct or a slice of structs or pointers to structs, with
+// complete keys.
+//
+// This is useful for read models that are computed in memory. Note that the
+// cached values are lost on eviction, so they should be reproducible.
+func (g *Goon) WarmCache(src interface{}) error {
+	v := reflect.Indirect(reflect.ValueOf(src))
+	var srcs []interface{}
+	if v.Kind() == reflect.Slice {
+		srcs = make([]interface{}, v.Len())
+		for i := range srcs {
+			srcs[i] = elemInterface(v.Index(i))
+		}
+	} else {
+		srcs = []interface{}{src}
+	}
+	if _, err := g.extractKeys(srcs, false); err != nil {
+		return err
+	}
+	if len(srcs) == 0 {
+		return nil
+	}
+	return g.putMemcache(srcs, bytes.Repeat([]byte{1}, len(srcs)))
+}
+
+// Stats counts how the entities requested from a Goon were found.
+type Stats struct {
+	LocalHits         int // Entities found in the local memory cache
+	MemcacheHits      int // Entities found in memcache
+	MemcacheMisses    int // Entities not found in memcache
+	DatastoreReads    int // Entities requested from the datastore
+	MemcachePutErrors int // Failed or timed out memcache writes
+	CacheLayerHits    int // Entities found in the CacheLayer
+}
+
+// Stats returns a snapshot of g's cache statistics. Entities that are known
+// not to exist count as found. Operations within a transaction aren't counted.
+func (g *Goon) Stats() Stats {
+	g.cacheLock.RLock()
+	defer g.cacheLock.RUnlock()
+	return g.stats
+}
+
+func (g *Goon) addStats(s Stats) {
+	g.cacheLock.Lock()
+	g.stats.LocalHits += s.LocalHits
+	g.stats.MemcacheHits += s.MemcacheHits
+	g.stats.MemcacheMisses += s.MemcacheMisses
+	g.stats.DatastoreReads += s.DatastoreReads
+	g.stats.MemcachePutErrors += s.MemcachePutErrors
+	g.stats.CacheLayerHits += s.CacheLayerHits
+	g.cacheLock.Unlock()
+}
+
 // Get loads the entity based on dst's key into dst
 // If there is no such entity for the key, Get returns
 // datastore.ErrNoSuchEntity.
@@ -401,23 +1492,189 @@ func (g *Goon) Get(dst interface{}) error {
 	return nil
 }
 
+// getMultiLimit is the default GetMultiLimit.
 const getMultiLimit = 1000
 
 // GetMulti is a batch version of Get.
 //
 // dst must be a *[]S, *[]*S, *[]I, []S, []*S, or []I, for some struct type S,
 // or some interface type I. If *[]I or []I, each element must be a struct pointer.
+//
+// If only some of the entities can't be loaded, an appengine.MultiError is
+// returned, and every element of dst without an error is fully loaded. If
+// NilMissing is set, the elements of a []*S or []I dst for which there is no
+// such entity are set to nil.
 func (g *Goon) GetMulti(dst interface{}) error {
+	err := g.getMulti(dst, nil)
+	g.nilMissing(dst, err)
+	return err
+}
+
+// nilMissing sets the elements of dst that don't exist according to err, as
+// returned by getMulti, to nil if g.NilMissing is set.
+func (g *Goon) nilMissing(dst interface{}, err error) {
+	if merr, ok := err.(appengine.MultiError); ok && g.NilMissing {
+		v := reflect.Indirect(reflect.ValueOf(dst))
+		for i, e := range merr {
+			if vi := v.Index(i); e == datastore.ErrNoSuchEntity && (vi.Kind() == reflect.Ptr || vi.Kind() == reflect.Interface) {
+				vi.Set(reflect.Zero(vi.Type()))
+			}
+		}
+	}
+}
+
+// GetByKeys loads the entities for keys, of any kinds, into new struct
+// pointers from newFunc, which is called with each key, and returns them in
+// the order of keys. Otherwise it is the same as GetMulti; missing entities
+// result in an appengine.MultiError with datastore.ErrNoSuchEntity at their
+// indices.
+func (g *Goon) GetByKeys(keys []*datastore.Key, newFunc func(*datastore.Key) interface{}) ([]interface{}, error) {
+	dst := make([]interface{}, len(keys))
+	for i, key := range keys {
+		dst[i] = newFunc(key)
+		if err := g.setStructKey(dst[i], key); err != nil {
+			return nil, err
+		}
+	}
+	return dst, g.GetMulti(dst)
+}
+
+// GetMap loads the entities for keys into the map pointed to by dst, which
+// must be a *map[*datastore.Key]*S or *map[string]*S for some struct type S.
+// String map keys are the encoded datastore keys. A nil map is allocated.
+// Only the entities that exist are added to the map, so there is no error for
+// missing entities. If some of the others can't be loaded, an
+// appengine.MultiError indexed like keys is returned.
+func (g *Goon) GetMap(keys []*datastore.Key, dst interface{}) error {
+	mv := reflect.ValueOf(dst)
+	if mv.Kind() != reflect.Ptr || mv.Elem().Kind() != reflect.Map {
+		return fmt.Errorf("goon: Expected dst to be a pointer to a map, got instead: %T", dst)
+	}
+	mv = mv.Elem()
+	mt := mv.Type()
+	if mt.Key() != reflect.TypeOf(&datastore.Key{}) && mt.Key().Kind() != reflect.String {
+		return fmt.Errorf("goon: Expected map keys to be *datastore.Key or string, got instead: %v", mt.Key())
+	}
+	if mt.Elem().Kind() != reflect.Ptr || mt.Elem().Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("goon: Expected map values to be pointers to structs, got instead: %v", mt.Elem())
+	}
+
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		values[i] = reflect.New(mt.Elem().Elem()).Interface()
+		if err := g.setStructKey(values[i], key); err != nil {
+			return err
+		}
+	}
+	var merr appengine.MultiError
+	if err := g.GetMulti(values); err != nil {
+		var ok bool
+		if merr, ok = err.(appengine.MultiError); !ok {
+			return err
+		}
+	}
+
+	if mv.IsNil() {
+		mv.Set(reflect.MakeMapWithSize(mt, len(keys)))
+	}
+	failed := false
+	for i, key := range keys {
+		if merr != nil && merr[i] != nil {
+			if merr[i] == datastore.ErrNoSuchEntity {
+				merr[i] = nil
+			} else {
+				failed = true
+			}
+			continue
+		}
+		var mk reflect.Value
+		if mt.Key().Kind() == reflect.String {
+			mk = reflect.ValueOf(key.Encode()).Convert(mt.Key())
+		} else {
+			mk = reflect.ValueOf(key)
+		}
+		mv.SetMapIndex(mk, reflect.ValueOf(values[i]))
+	}
+	if failed {
+		return merr
+	}
+	return nil
+}
+
+// Source tells where GetMultiSource found an entity.
+type Source int
+
+const (
+	SourceLocal      Source = iota // The local memory cache
+	SourceMemcache                 // Memcache
+	SourceDatastore                // The datastore
+	SourceMiss                     // Nowhere: the entity doesn't exist or couldn't be loaded
+	SourceCacheLayer               // The CacheLayer
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceLocal:
+		return "local"
+	case SourceMemcache:
+		return "memcache"
+	case SourceDatastore:
+		return "datastore"
+	case SourceMiss:
+		return "miss"
+	case SourceCacheLayer:
+		return "cachelayer"
+	}
+	return fmt.Sprintf("Source(%d)", int(s))
+}
+
+// GetMultiSource is like GetMulti, but also returns where each element of dst
+// was loaded from. It is meant for debugging and tuning caching, e.g. to
+// check that WarmCache is effective. Entities in the local cache of a
+// transaction are the ones put earlier in the transaction.
+//
+// If err is an appengine.MultiError, the elements with an error are
+// SourceMiss. Any other error returns nil sources.
+func (g *Goon) GetMultiSource(dst interface{}) ([]Source, error) {
+	v := reflect.Indirect(reflect.ValueOf(dst))
+	if v.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("goon: value must be a slice or pointer-to-slice")
+	}
+	sources := make([]Source, v.Len())
+	err := g.getMulti(dst, sources)
+	g.nilMissing(dst, err)
+	if err == nil {
+		return sources, nil
+	}
+	merr, ok := err.(appengine.MultiError)
+	if !ok {
+		return nil, err
+	}
+	for i, e := range merr {
+		if e != nil {
+			sources[i] = SourceMiss
+		}
+	}
+	return sources, err
+}
+
+// getMulti is GetMulti. If sources isn't nil, it records where every element
+// of dst that could be loaded was found.
+func (g *Goon) getMulti(dst interface{}, sources []Source) error {
 	keys, err := g.extractKeys(dst, false) // don't allow incomplete keys on a Get request
 	if err != nil {
 		return err
 	}
 
 	v := reflect.Indirect(reflect.ValueOf(dst))
+	setSource := func(i int, s Source) {
+		if sources != nil {
+			sources[i] = s
+		}
+	}
 
 	if g.inTransaction {
-		// todo: support getMultiLimit in transactions
-		return datastore.GetMulti(g.Context, keys, v.Interface())
+		return g.getMultiTransaction(keys, v, setSource)
 	}
 
 	var dskeys []*datastore.Key
@@ -427,6 +1684,8 @@ func (g *Goon) GetMulti(dst interface{}) error {
 	var memkeys []string
 	var mixs []int
 
+	multiErr := make(appengine.MultiError, len(keys))
+	var hits []string
 	g.cacheLock.RLock()
 	for i, key := range keys {
 		m := memkey(key)
@@ -437,10 +1696,19 @@ func (g *Goon) GetMulti(dst interface{}) error {
 		}
 
 		if s, present := g.cache[m]; present {
-			if vi.Kind() == reflect.Interface {
-				vi = vi.Elem()
+			if g.cacheLimit > 0 {
+				hits = append(hits, m)
+			}
+			if _, miss := s.(noSuchEntity); miss {
+				multiErr[i] = datastore.ErrNoSuchEntity
+				continue
+			}
+			if err := setFromCache(key, s, vi); err != nil {
+				g.cacheLock.RUnlock()
+				g.error(err)
+				return err
 			}
-			reflect.Indirect(vi).Set(reflect.Indirect(reflect.ValueOf(s)))
+			setSource(i, SourceLocal)
 		} else {
 			memkeys = append(memkeys, m)
 			mixs = append(mixs, i)
@@ -450,15 +1718,61 @@ func (g *Goon) GetMulti(dst interface{}) error {
 		}
 	}
 	g.cacheLock.RUnlock()
+	if len(hits) > 0 {
+		g.cacheLock.Lock()
+		for _, m := range hits {
+			g.touchMemoryKey(m)
+		}
+		g.cacheLock.Unlock()
+	}
 
+	stats := Stats{LocalHits: len(keys) - len(memkeys)}
+	if g.CacheLayer != nil && !g.DisableMemcache && len(memkeys) > 0 {
+		found := g.CacheLayer.GetFromCache(g.prefixKeys(memkeys))
+		var badkeys []string
+		n := 0
+		for i, m := range memkeys {
+			if b, present := found[g.CachePrefix+m]; present {
+				err := g.deserializeCopy(dsdst[i], b)
+				if err == nil || err == datastore.ErrNoSuchEntity {
+					if err == nil {
+						g.putMemory(dsdst[i])
+						setSource(mixs[i], SourceCacheLayer)
+					} else {
+						multiErr[mixs[i]] = err
+						g.putMemoryMiss(dsdst[i])
+					}
+					stats.CacheLayerHits++
+					continue
+				}
+				g.error(err)
+				badkeys = append(badkeys, g.CachePrefix+m)
+			}
+			memkeys[n], mixs[n] = memkeys[i], mixs[i]
+			dskeys[n], dsdst[n], dixs[n] = dskeys[i], dsdst[i], dixs[i]
+			n++
+		}
+		memkeys, mixs = memkeys[:n], mixs[:n]
+		dskeys, dsdst, dixs = dskeys[:n], dsdst[:n], dixs[:n]
+		if len(badkeys) > 0 {
+			g.deleteCacheLayer(badkeys)
+		}
+	}
 	if len(memkeys) == 0 {
+		g.addStats(stats)
+		if anyError(multiErr) {
+			return realError(multiErr)
+		}
 		return nil
 	}
 
-	multiErr, any := make(appengine.MultiError, len(keys)), false
-	toc, cancel := context.WithTimeout(g.Context, MemcacheGetTimeout)
-	memvalues, err := memcache.GetMulti(toc, memkeys)
-	cancel()
+	var memvalues map[string]*memcache.Item
+	if !g.DisableMemcache {
+		g.fakeDelay()
+		toc, cancel := context.WithTimeout(g.rpcContext("memcache.GetMulti"), MemcacheGetTimeout)
+		memvalues, err = g.getMemcache(toc, memkeys)
+		cancel()
+	}
 	if appengine.IsTimeoutError(err) {
 		g.timeoutError(err)
 		err = nil
@@ -473,37 +1787,56 @@ func (g *Goon) GetMulti(dst interface{}) error {
 		// we only want to check the returned map if there weren't any errors
 		// unlike the datastore, memcache will return a smaller map with no error if some of the keys were missed
 
+		var badkeys []string
 		for i, m := range memkeys {
 			d := v.Index(mixs[i]).Interface()
 			if v.Index(mixs[i]).Kind() == reflect.Struct {
 				d = v.Index(mixs[i]).Addr().Interface()
 			}
 			if s, present := memvalues[m]; present {
-				err := deserializeStruct(d, s.Value)
-				if err == datastore.ErrNoSuchEntity {
-					any = true // this flag tells GetMulti to return multiErr later
-					multiErr[mixs[i]] = err
-				} else if err != nil {
-					g.error(err)
-					return err
-				} else {
+				err := g.deserializeCopy(d, s.Value)
+				if err == nil {
 					g.putMemory(d)
+					setSource(mixs[i], SourceMemcache)
+					continue
+				} else if err == datastore.ErrNoSuchEntity {
+					multiErr[mixs[i]] = err
+					g.putMemoryMiss(d)
+					continue
 				}
-			} else {
-				dskeys = append(dskeys, keys[mixs[i]])
-				dsdst = append(dsdst, d)
-				dixs = append(dixs, mixs[i])
+				// The value is unreadable, e.g. written by an older version of the struct,
+				// so evict it and treat it as a miss
+				g.error(err)
+				badkeys = append(badkeys, m)
 			}
+			dskeys = append(dskeys, keys[mixs[i]])
+			dsdst = append(dsdst, d)
+			dixs = append(dixs, mixs[i])
 		}
-		if len(dskeys) == 0 {
-			if any {
-				return realError(multiErr)
-			}
-			return nil
+		if len(badkeys) > 0 {
+			g.deleteMemcache(badkeys)
 		}
 	}
 
-	goroutines := (len(dskeys)-1)/getMultiLimit + 1
+	if !g.DisableMemcache {
+		stats.MemcacheHits = len(memkeys) - len(dskeys)
+		stats.MemcacheMisses = len(dskeys)
+	}
+	stats.DatastoreReads = len(dskeys)
+	g.addStats(stats)
+	if len(dskeys) == 0 {
+		if anyError(multiErr) {
+			return realError(multiErr)
+		}
+		return nil
+	}
+
+	for _, idx := range dixs {
+		setSource(idx, SourceDatastore)
+	}
+
+	limit := batchLimit(g.GetMultiLimit, getMultiLimit)
+	goroutines := (len(dskeys)-1)/limit + 1
 	var wg sync.WaitGroup
 	wg.Add(goroutines)
 	for i := 0; i < goroutines; i++ {
@@ -511,19 +1844,29 @@ func (g *Goon) GetMulti(dst interface{}) error {
 			defer wg.Done()
 			var toCache []interface{}
 			var exists []byte
-			lo := i * getMultiLimit
-			hi := (i + 1) * getMultiLimit
+			lo := i * limit
+			hi := (i + 1) * limit
 			if hi > len(dskeys) {
 				hi = len(dskeys)
 			}
-			gmerr := datastore.GetMulti(g.Context, dskeys[lo:hi], dsdst[lo:hi])
+			if err := g.Context.Err(); err != nil {
+				// The request was cancelled or past its deadline before the
+				// batches were started, don't bother
+				for _, idx := range dixs[lo:hi] {
+					multiErr[idx] = err
+				}
+				return
+			}
+			gmerr := g.retry("datastore.GetMulti", func(c context.Context) error {
+				return datastore.GetMulti(c, dskeys[lo:hi], dsdst[lo:hi])
+			})
+			gmerr = g.ignoreFieldMismatch(gmerr)
 			if gmerr != nil {
-				any = true // this flag tells GetMulti to return multiErr later
 				merr, ok := gmerr.(appengine.MultiError)
 				if !ok {
 					g.error(gmerr)
-					for j := lo; j < hi; j++ {
-						multiErr[j] = gmerr
+					for _, idx := range dixs[lo:hi] {
+						multiErr[idx] = gmerr
 					}
 					return
 				}
@@ -543,6 +1886,13 @@ func (g *Goon) GetMulti(dst interface{}) error {
 				toCache = append(toCache, dsdst[lo:hi]...)
 				exists = append(exists, bytes.Repeat([]byte{1}, hi-lo)...)
 			}
+			if g.AfterGet != nil {
+				for i, idx := range dixs[lo:hi] {
+					if multiErr[idx] == nil {
+						g.AfterGet(dskeys[lo+i], dsdst[lo+i])
+					}
+				}
+			}
 			if len(toCache) > 0 {
 				if err := g.putMemcache(toCache, exists); err != nil {
 					g.error(err)
@@ -554,12 +1904,333 @@ func (g *Goon) GetMulti(dst interface{}) error {
 		}(i)
 	}
 	wg.Wait()
-	if any {
+	if anyError(multiErr) {
 		return realError(multiErr)
 	}
 	return nil
 }
 
+// setFromCache copies the cached entity s into the element vi of a GetMulti
+// dst, so that dst never aliases the cache.
+func setFromCache(key *datastore.Key, s interface{}, vi reflect.Value) error {
+	if vi.Kind() == reflect.Interface {
+		vi = vi.Elem()
+	}
+	sv, dv := reflect.Indirect(reflect.ValueOf(s)), reflect.Indirect(vi)
+	if sv.Type() != dv.Type() {
+		return fmt.Errorf("goon: cached value for key %v has type %v, expected %v", key, sv.Type(), dv.Type())
+	}
+	dv.Set(sv)
+	return nil
+}
+
+// getMultiTransaction is GetMulti within a transaction. Entities put or
+// deleted earlier in the transaction are served from its pending changes;
+// the rest are read from the datastore.
+func (g *Goon) getMultiTransaction(keys []*datastore.Key, v reflect.Value, setSource func(int, Source)) error {
+	var dskeys []*datastore.Key
+	var dsdst []interface{}
+	var dixs []int
+
+	multiErr := make(appengine.MultiError, len(keys))
+	g.cacheLock.RLock()
+	for i, key := range keys {
+		m := memkey(key)
+		vi := v.Index(i)
+		if vi.Kind() == reflect.Struct {
+			vi = vi.Addr()
+		}
+		if s, present := g.toSet[m]; present {
+			if err := setFromCache(key, s, vi); err != nil {
+				g.cacheLock.RUnlock()
+				g.error(err)
+				return err
+			}
+			setSource(i, SourceLocal)
+		} else if g.toDelete[m] {
+			multiErr[i] = datastore.ErrNoSuchEntity
+		} else {
+			dskeys = append(dskeys, key)
+			dsdst = append(dsdst, vi.Interface())
+			dixs = append(dixs, i)
+			setSource(i, SourceDatastore)
+		}
+	}
+	g.cacheLock.RUnlock()
+
+	if len(dskeys) > 0 {
+		// todo: support getMultiLimit in transactions
+		err := g.ignoreFieldMismatch(g.retry("datastore.GetMulti", func(c context.Context) error {
+			return datastore.GetMulti(c, dskeys, dsdst)
+		}))
+		if err != nil {
+			merr, ok := err.(appengine.MultiError)
+			if !ok {
+				return err
+			}
+			for j, idx := range dixs {
+				multiErr[idx] = merr[j]
+			}
+		}
+		if g.AfterGet != nil {
+			for j, idx := range dixs {
+				if multiErr[idx] == nil {
+					g.AfterGet(dskeys[j], dsdst[j])
+				}
+			}
+		}
+	}
+	if anyError(multiErr) {
+		return realError(multiErr)
+	}
+	return nil
+}
+
+// ignoreFieldMismatch removes the *datastore.ErrFieldMismatch errors from the
+// appengine.MultiError err, if g.IgnoreFieldMismatch is set.
+func (g *Goon) ignoreFieldMismatch(err error) error {
+	merr, ok := err.(appengine.MultiError)
+	if !ok || !g.IgnoreFieldMismatch {
+		return err
+	}
+	for i, e := range merr {
+		if _, ok := e.(*datastore.ErrFieldMismatch); ok {
+			merr[i] = nil
+		}
+	}
+	if anyError(merr) {
+		return merr
+	}
+	return nil
+}
+
+// CacheGet loads the entity based on dst's key into dst, like Get, but only
+// from the local memory cache, the CacheLayer and memcache. It never reads the
+// datastore, and returns false if the entity isn't cached. If the caches know
+// that there is no such entity, it returns datastore.ErrNoSuchEntity. Within a
+// transaction nothing is cached, so CacheGet always returns false.
+func (g *Goon) CacheGet(dst interface{}) (bool, error) {
+	if reflect.ValueOf(dst).Kind() != reflect.Ptr {
+		return false, fmt.Errorf("goon: expected pointer to a struct, got %#v", dst)
+	}
+	key, err := g.KeyError(dst)
+	if err != nil {
+		g.error(err)
+		return false, err
+	}
+	if g.inTransaction {
+		return false, nil
+	}
+	m := memkey(key)
+	dv := reflect.Indirect(reflect.ValueOf(dst))
+
+	g.cacheLock.RLock()
+	s, present := g.cache[m]
+	g.cacheLock.RUnlock()
+	if present {
+		g.addStats(Stats{LocalHits: 1})
+		if _, miss := s.(noSuchEntity); miss {
+			return false, datastore.ErrNoSuchEntity
+		}
+		sv := reflect.Indirect(reflect.ValueOf(s))
+		if sv.Type() != dv.Type() {
+			err := fmt.Errorf("goon: cached value for key %v has type %v, expected %v", key, sv.Type(), dv.Type())
+			g.error(err)
+			return false, err
+		}
+		dv.Set(sv)
+		g.cacheLock.Lock()
+		g.touchMemoryKey(m)
+		g.cacheLock.Unlock()
+		return true, nil
+	}
+
+	if g.DisableMemcache {
+		return false, nil
+	}
+	// Deserialize into a copy, so that a bad value can't leave dst half filled
+	tmp := reflect.New(dv.Type())
+	if g.CacheLayer != nil {
+		if b, present := g.CacheLayer.GetFromCache([]string{g.CachePrefix + m})[g.CachePrefix+m]; present {
+			tmp.Elem().Set(dv)
+			err := g.deserialize(tmp.Interface(), b)
+			if err == nil || err == datastore.ErrNoSuchEntity {
+				g.addStats(Stats{CacheLayerHits: 1})
+				if err != nil {
+					g.putMemoryMiss(dst)
+					return false, err
+				}
+				dv.Set(tmp.Elem())
+				g.putMemory(dst)
+				return true, nil
+			}
+			// The value is unreadable, so evict it and try memcache
+			g.error(err)
+			g.deleteCacheLayer([]string{g.CachePrefix + m})
+		}
+	}
+	g.fakeDelay()
+	toc, cancel := context.WithTimeout(g.rpcContext("memcache.Get"), MemcacheGetTimeout)
+	item, err := memcache.Get(toc, g.CachePrefix+m)
+	cancel()
+	if err != nil {
+		g.addStats(Stats{MemcacheMisses: 1})
+	}
+	if err == memcache.ErrCacheMiss {
+		return false, nil
+	} else if appengine.IsTimeoutError(err) {
+		g.timeoutError(err)
+		return false, nil
+	} else if err != nil {
+		g.error(err)
+		return false, nil
+	}
+	tmp.Elem().Set(dv)
+	if err := g.deserialize(tmp.Interface(), item.Value); err == datastore.ErrNoSuchEntity {
+		g.addStats(Stats{MemcacheHits: 1})
+		g.putMemoryMiss(dst)
+		return false, err
+	} else if err != nil {
+		// The value is unreadable, so evict it like GetMulti does
+		g.addStats(Stats{MemcacheMisses: 1})
+		g.error(err)
+		g.deleteMemcache([]string{m})
+		return false, nil
+	}
+	g.addStats(Stats{MemcacheHits: 1})
+	dv.Set(tmp.Elem())
+	g.putMemory(dst)
+	return true, nil
+}
+
+// Exists returns true if the entity for src's key exists. Unlike Get, the
+// entity is never decoded into src.
+func (g *Goon) Exists(src interface{}) (bool, error) {
+	exists, err := g.ExistsMulti([]interface{}{src})
+	if err != nil {
+		if me, ok := err.(appengine.MultiError); ok {
+			return false, me[0]
+		}
+		return false, err
+	}
+	return exists[0], nil
+}
+
+// discardLoader is a datastore.PropertyLoadSaver that ignores all properties.
+// It is used to check for the existence of entities without decoding them.
+type discardLoader struct{}
+
+func (*discardLoader) Load([]datastore.Property) error     { return nil }
+func (*discardLoader) Save() ([]datastore.Property, error) { return nil, nil }
+
+// ExistsMulti is a batch version of Exists.
+//
+// src must satisfy the same conditions as the dst argument to GetMulti. The
+// local cache, the CacheLayer and memcache are consulted first, and only the
+// keys missing from all of them are looked up in the datastore. Nothing is
+// cached by ExistsMulti.
+func (g *Goon) ExistsMulti(src interface{}) ([]bool, error) {
+	keys, err := g.extractKeys(src, false) // don't allow incomplete keys on an Exists request
+	if err != nil {
+		return nil, err
+	}
+	exists := make([]bool, len(keys))
+
+	var dskeys []*datastore.Key
+	var dixs []int
+
+	if g.inTransaction {
+		dskeys = keys
+		for i := range keys {
+			dixs = append(dixs, i)
+		}
+	} else {
+		var memkeys []string
+		var mixs []int
+
+		g.cacheLock.RLock()
+		for i, key := range keys {
+			m := memkey(key)
+			if s, present := g.cache[m]; present {
+				_, miss := s.(noSuchEntity)
+				exists[i] = !miss
+			} else {
+				memkeys = append(memkeys, m)
+				mixs = append(mixs, i)
+			}
+		}
+		g.cacheLock.RUnlock()
+
+		if g.CacheLayer != nil && !g.DisableMemcache && len(memkeys) > 0 {
+			found := g.CacheLayer.GetFromCache(g.prefixKeys(memkeys))
+			n := 0
+			for i, m := range memkeys {
+				if b, present := found[g.CachePrefix+m]; present && len(b) > 0 {
+					exists[mixs[i]] = b[0] != serializationStateEmpty
+					continue
+				}
+				memkeys[n], mixs[n] = memkeys[i], mixs[i]
+				n++
+			}
+			memkeys, mixs = memkeys[:n], mixs[:n]
+		}
+
+		var memvalues map[string]*memcache.Item
+		if len(memkeys) > 0 && !g.DisableMemcache {
+			g.fakeDelay()
+			toc, cancel := context.WithTimeout(g.rpcContext("memcache.GetMulti"), MemcacheGetTimeout)
+			memvalues, err = g.getMemcache(toc, memkeys)
+			cancel()
+			if appengine.IsTimeoutError(err) {
+				g.timeoutError(err)
+			} else if err != nil {
+				g.error(err)
+			}
+		}
+		for i, m := range memkeys {
+			if item, present := memvalues[m]; present && len(item.Value) > 0 {
+				exists[mixs[i]] = item.Value[0] != serializationStateEmpty
+			} else {
+				dskeys = append(dskeys, keys[mixs[i]])
+				dixs = append(dixs, mixs[i])
+			}
+		}
+	}
+
+	multiErr := make(appengine.MultiError, len(keys))
+	limit := batchLimit(g.GetMultiLimit, getMultiLimit)
+	for lo := 0; lo < len(dskeys); lo += limit {
+		hi := lo + limit
+		if hi > len(dskeys) {
+			hi = len(dskeys)
+		}
+		if err := g.Context.Err(); err != nil {
+			// The request is cancelled or past its deadline, don't bother
+			g.error(err)
+			return nil, err
+		}
+		gmerr := g.retry("datastore.GetMulti", func(c context.Context) error {
+			return datastore.GetMulti(c, dskeys[lo:hi], make([]discardLoader, hi-lo))
+		})
+		merr, ok := gmerr.(appengine.MultiError)
+		if gmerr != nil && !ok {
+			g.error(gmerr)
+			return nil, gmerr
+		}
+		for i, idx := range dixs[lo:hi] {
+			if merr == nil || merr[i] == nil {
+				exists[idx] = true
+			} else if merr[i] != datastore.ErrNoSuchEntity {
+				multiErr[idx] = merr[i]
+			}
+		}
+	}
+	if anyError(multiErr) {
+		return exists, realError(multiErr)
+	}
+	return exists, nil
+}
+
 // Delete deletes the entity for the given key.
 func (g *Goon) Delete(key *datastore.Key) error {
 	keys := []*datastore.Key{key}
@@ -570,8 +2241,35 @@ func (g *Goon) Delete(key *datastore.Key) error {
 	return err
 }
 
+// DeleteMany is a variadic version of DeleteMulti.
+func (g *Goon) DeleteMany(keys ...*datastore.Key) error {
+	return g.DeleteMulti(keys)
+}
+
+// DeleteBySrc deletes the entity for src's key.
+func (g *Goon) DeleteBySrc(src interface{}) error {
+	key, err := g.KeyError(src)
+	if err != nil {
+		return err
+	} else if key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	return g.Delete(key)
+}
+
+// deleteMultiLimit is the default DeleteMultiLimit.
 const deleteMultiLimit = 500
 
+// anyError returns true if any error in multiError is non-nil.
+func anyError(multiError appengine.MultiError) bool {
+	for _, err := range multiError {
+		if err != nil {
+			return true
+		}
+	}
+	return false
+}
+
 // Returns a single error if each error in MultiError is the same
 // otherwise, returns multiError or nil (if multiError is empty)
 func realError(multiError appengine.MultiError) error {
@@ -609,6 +2307,10 @@ func (g *Goon) DeleteMulti(keys []*datastore.Key) error {
 		return nil
 		// not an error, and it was "successful", so return nil
 	}
+	if g.DryRun {
+		g.infof(g.Context, "goon: dry run, not deleting %d entities: %v", len(keys), keys)
+		return nil
+	}
 	memkeys := make([]string, len(keys))
 
 	g.cacheLock.Lock()
@@ -620,7 +2322,7 @@ func (g *Goon) DeleteMulti(keys []*datastore.Key) error {
 			delete(g.toSet, mk)
 			g.toDelete[mk] = true
 		} else {
-			delete(g.cache, mk)
+			g.deleteMemoryKey(mk)
 		}
 	}
 	g.cacheLock.Unlock()
@@ -632,25 +2334,35 @@ func (g *Goon) DeleteMulti(keys []*datastore.Key) error {
 		for _, mk := range memkeys {
 			g.toDeleteMC[mk] = true
 		}
-	} else {
-		defer memcache.DeleteMulti(g.Context, memkeys)
+	} else if !g.DisableMemcache {
+		defer g.deleteMemcache(memkeys)
 	}
 
-	multiErr, any := make(appengine.MultiError, len(keys)), false
-	goroutines := (len(keys)-1)/deleteMultiLimit + 1
+	multiErr := make(appengine.MultiError, len(keys))
+	limit := batchLimit(g.DeleteMultiLimit, deleteMultiLimit)
+	goroutines := (len(keys)-1)/limit + 1
 	var wg sync.WaitGroup
 	wg.Add(goroutines)
 	for i := 0; i < goroutines; i++ {
 		go func(i int) {
 			defer wg.Done()
-			lo := i * deleteMultiLimit
-			hi := (i + 1) * deleteMultiLimit
+			lo := i * limit
+			hi := (i + 1) * limit
 			if hi > len(keys) {
 				hi = len(keys)
 			}
-			dmerr := datastore.DeleteMulti(g.Context, keys[lo:hi])
+			if err := g.Context.Err(); err != nil {
+				// The request was cancelled or past its deadline before the
+				// batches were started, don't bother
+				for j := lo; j < hi; j++ {
+					multiErr[j] = err
+				}
+				return
+			}
+			dmerr := g.retry("datastore.DeleteMulti", func(c context.Context) error {
+				return datastore.DeleteMulti(c, keys[lo:hi])
+			})
 			if dmerr != nil {
-				any = true // this flag tells DeleteMulti to return multiErr later
 				merr, ok := dmerr.(appengine.MultiError)
 				if !ok {
 					g.error(dmerr)
@@ -664,7 +2376,7 @@ func (g *Goon) DeleteMulti(keys []*datastore.Key) error {
 		}(i)
 	}
 	wg.Wait()
-	if any {
+	if anyError(multiErr) {
 		return realError(multiErr)
 	}
 	return nil
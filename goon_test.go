@@ -17,15 +17,19 @@
 package goon
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"google.golang.org/appengine"
-
-	"golang.org/x/net/context"
-
 	"google.golang.org/appengine/aetest"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/memcache"
@@ -2347,6 +2351,72 @@ func TestCustomKindName(t *testing.T) {
 	}
 }
 
+type User struct {
+	Id   int64 `datastore:"-" goon:"id"`
+	Name string
+}
+
+// UserV2 is a renamed User that must keep using the User kind.
+type UserV2 struct {
+	Id   int64 `datastore:"-" goon:"id"`
+	Name string
+}
+
+func renamedKindName(src interface{}) string {
+	if _, ok := reflect.Indirect(reflect.ValueOf(src)).Interface().(UserV2); ok {
+		return "User"
+	}
+	return DefaultKindName(src)
+}
+
+func TestKindNameResolverRename(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+	g.KindNameResolver = renamedKindName
+
+	if kind := g.Kind(&UserV2{Id: 1}); kind != "User" {
+		t.Fatalf("Expected kind User, got %v", kind)
+	}
+	if kind := g.Kind(&HasId{Id: 1}); kind != "HasId" {
+		t.Fatalf("Expected kind HasId, got %v", kind)
+	}
+
+	if _, err := g.Put(&User{Id: 1, Name: "old"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	// A fresh Goon so that the Get has to go to memcache or the datastore
+	g = FromContext(c)
+	g.KindNameResolver = renamedKindName
+	u := &UserV2{Id: 1}
+	if err := g.Get(u); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	} else if u.Name != "old" {
+		t.Errorf("Expected old, got %v", u.Name)
+	}
+	memcache.Flush(c)
+	g.FlushLocalCache()
+	u = &UserV2{Id: 1}
+	if err := g.Get(u); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	} else if u.Name != "old" {
+		t.Errorf("Expected old, got %v", u.Name)
+	}
+
+	key, err := g.Put(&UserV2{Id: 2, Name: "new"})
+	if err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	} else if key.Kind() != "User" {
+		t.Errorf("Expected kind User, got %v", key.Kind())
+	}
+	if err := datastore.Get(c, key, &User{}); err != nil {
+		t.Errorf("Unexpected error on datastore.Get - %v", err)
+	}
+}
+
 func TestMultis(t *testing.T) {
 	c, closer, err := aetest.NewContext()
 	if err != nil {
@@ -2484,3 +2554,4127 @@ func TestParents(t *testing.T) {
 		t.Fatalf("parent of key not equal '%s' v '%s'! ", dk, rootKey)
 	}
 }
+
+// rpcRecorder records every App Engine API call made through the contexts it
+// wraps, so tests can assert which RPCs an operation issued.
+type rpcRecorder struct {
+	sync.Mutex
+	calls []string
+}
+
+func (r *rpcRecorder) wrap(c context.Context) context.Context {
+	return appengine.WithAPICallFunc(c, func(ctx context.Context, service, method string, in, out proto.Message) error {
+		r.Lock()
+		r.calls = append(r.calls, service+"."+method)
+		r.Unlock()
+		return appengine.APICall(ctx, service, method, in, out)
+	})
+}
+
+// count returns the number of recorded calls to service.method.
+func (r *rpcRecorder) count(call string) int {
+	r.Lock()
+	defer r.Unlock()
+	n := 0
+	for _, c := range r.calls {
+		if c == call {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *rpcRecorder) reset() {
+	r.Lock()
+	r.calls = nil
+	r.Unlock()
+}
+
+func TestRetryIncompletePut(t *testing.T) {
+	c, closer := newConsistentContext(t)
+	defer closer()
+	g := FromContext(c)
+	g.DisableMemcache = true
+	g.RetryAttempts = 3
+	g.RetryBackoff = time.Millisecond
+	g.ErrorHandler = func(context.Context, error) {}
+
+	// The first Put is applied, but reported as timed out
+	var lock sync.Mutex
+	timedOut := false
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(appengine.WithAPICallFunc(c, func(ctx context.Context, service, method string, in, out proto.Message) error {
+		err := appengine.APICall(ctx, service, method, in, out)
+		lock.Lock()
+		defer lock.Unlock()
+		if err == nil && service == "datastore_v3" && method == "Put" && !timedOut {
+			timedOut = true
+			return fakeTimeoutError{}
+		}
+		return err
+	}))
+
+	if _, err := g.Put(&HasId{Name: "new"}); err == nil {
+		t.Errorf("Expected the timeout to be returned")
+	}
+	if n := rec.count("datastore_v3.Put"); n != 1 {
+		t.Errorf("Expected 1 Put of the incomplete key, got %v", n)
+	}
+	if n, err := datastore.NewQuery("HasId").Count(c); err != nil {
+		t.Fatalf("Unexpected error on Count - %v", err)
+	} else if n != 1 {
+		t.Errorf("Expected 1 entity, got %v", n)
+	}
+
+	// Complete keys are still retried
+	rec.reset()
+	lock.Lock()
+	timedOut = false
+	lock.Unlock()
+	if _, err := g.Put(&HasId{Id: 1, Name: "one"}); err != nil {
+		t.Errorf("Unexpected error on Put - %v", err)
+	}
+	if n := rec.count("datastore_v3.Put"); n != 2 {
+		t.Errorf("Expected 2 Puts of the complete key, got %v", n)
+	}
+}
+
+func TestContextDecorator(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	var lock sync.Mutex
+	var ops []string
+	rec := &rpcRecorder{}
+	g.ContextDecorator = func(c context.Context, op string) context.Context {
+		lock.Lock()
+		ops = append(ops, op)
+		lock.Unlock()
+		return rec.wrap(c)
+	}
+	hasOp := func(op string) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, o := range ops {
+			if o == op {
+				return true
+			}
+		}
+		return false
+	}
+
+	hid := &HasId{Id: 1, Name: "decorated"}
+	if _, err := g.Put(hid); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if !hasOp("datastore.PutMulti") {
+		t.Errorf("Expected the decorator to be called for datastore.PutMulti, got %v", ops)
+	}
+	if !hasOp("memcache.DeleteMulti") {
+		t.Errorf("Expected the decorator to be called for memcache.DeleteMulti, got %v", ops)
+	}
+	if rec.count("datastore_v3.Put") != 1 {
+		t.Errorf("Expected the decorated context to be used for the datastore Put, got calls %v", rec.calls)
+	}
+
+	g.FlushLocalCache()
+	memcache.Flush(c)
+	if err := g.Get(&HasId{Id: 1}); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	if !hasOp("memcache.GetMulti") || !hasOp("datastore.GetMulti") || !hasOp("memcache.SetMulti") {
+		t.Errorf("Expected the decorator to be called for all Get RPCs, got %v", ops)
+	}
+	if rec.count("memcache.Get") != 1 || rec.count("datastore_v3.Get") != 1 || rec.count("memcache.Set") != 1 {
+		t.Errorf("Expected the decorated context to be used for all Get RPCs, got calls %v", rec.calls)
+	}
+
+	// The decorated context must not leak into the Goon itself
+	if g.Context != c {
+		t.Errorf("Expected the Goon context to be left untouched")
+	}
+}
+
+// newConsistentContext starts an aetest instance with a strongly consistent
+// datastore, for tests that depend on the results of non-ancestor queries.
+func newConsistentContext(t *testing.T) (context.Context, func()) {
+	inst, err := aetest.NewInstance(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	req, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		inst.Close()
+		t.Fatalf("Could not create aetest request - %v", err)
+	}
+	return appengine.NewContext(req), func() { inst.Close() }
+}
+
+type IterItem struct {
+	Id   int64 `datastore:"-" goon:"id"`
+	Name string
+}
+
+func TestIterateKind(t *testing.T) {
+	c, closer := newConsistentContext(t)
+	defer closer()
+	g := FromContext(c)
+
+	const total = 300
+	items := make([]*IterItem, total)
+	for i := range items {
+		items[i] = &IterItem{Id: int64(i + 1), Name: "iter"}
+	}
+	if _, err := g.PutMulti(items); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+
+	seen := make(map[int64]int)
+	it := g.IterateKind("IterItem", IterItem{}, 64)
+	for {
+		item := &IterItem{}
+		key, err := it.Next(item)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			t.Fatalf("Unexpected error on Next - %v", err)
+		}
+		if key.IntID() != item.Id {
+			t.Errorf("Key %v doesn't match item id %v", key, item.Id)
+		}
+		if item.Name != "iter" {
+			t.Errorf("Item %v was not loaded, got %#v", item.Id, item)
+		}
+		seen[item.Id]++
+	}
+	if len(seen) != total {
+		t.Errorf("Expected %v distinct entities, got %v", total, len(seen))
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("Entity %v was returned %v times", id, n)
+		}
+	}
+
+	// Every entity should now be in the local cache
+	g.cacheLock.RLock()
+	cached := len(g.cache)
+	g.cacheLock.RUnlock()
+	if cached != total {
+		t.Errorf("Expected %v entities in the local cache, got %v", total, cached)
+	}
+}
+
+func TestLocalCacheGet(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+
+	if _, err := g.Put(&HasId{Id: 1, Name: "local"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	rec.reset()
+
+	hid := &HasId{Id: 1}
+	if err := g.Get(hid); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	} else if hid.Name != "local" {
+		t.Errorf("Expected 'local', got %v", hid.Name)
+	}
+	hids := []HasId{{Id: 1}}
+	if err := g.GetMulti(&hids); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	} else if hids[0].Name != "local" {
+		t.Errorf("Expected 'local', got %v", hids[0].Name)
+	}
+	if len(rec.calls) != 0 {
+		t.Errorf("Expected no RPCs for locally cached entities, got %v", rec.calls)
+	}
+
+	// Mutating the result must not affect the cache
+	hid.Name = "mutated"
+	hid = &HasId{Id: 1}
+	if err := g.Get(hid); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	} else if hid.Name != "local" {
+		t.Errorf("Expected 'local', got %v", hid.Name)
+	}
+
+	// A different type sharing the same key must be rejected
+	if _, err := g.Put(&MigrationA{Id: 1}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if err := g.Get(&MigrationB{Identification: 1}); err == nil {
+		t.Errorf("Expected an error on a cached type mismatch")
+	}
+}
+
+func TestGetAllCaches(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+
+	parent := datastore.NewKey(c, "GetAllParent", "", 1, nil)
+	items := []*HasParent{
+		{Id: 1, P: parent, Name: "one"},
+		{Id: 2, P: parent, Name: "two"},
+		{Id: 3, P: parent, Name: "three"},
+	}
+	if _, err := g.PutMulti(items); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+	memcache.Flush(c)
+
+	var results []HasParent
+	if _, err := g.GetAll(datastore.NewQuery("HasParent").Ancestor(parent), &results); err != nil {
+		t.Fatalf("Unexpected error on GetAll - %v", err)
+	} else if len(results) != len(items) {
+		t.Fatalf("Expected %v results, got %v", len(items), len(results))
+	}
+
+	// Served from the local cache
+	rec.reset()
+	hp := &HasParent{Id: 2, P: parent}
+	if err := g.Get(hp); err != nil {
+		t.Errorf("Unexpected error on Get - %v", err)
+	} else if hp.Name != "two" {
+		t.Errorf("Expected 'two', got %v", hp.Name)
+	}
+	if len(rec.calls) != 0 {
+		t.Errorf("Expected no RPCs, got %v", rec.calls)
+	}
+
+	// Served from memcache
+	g.FlushLocalCache()
+	rec.reset()
+	hp = &HasParent{Id: 3, P: parent}
+	if err := g.Get(hp); err != nil {
+		t.Errorf("Unexpected error on Get - %v", err)
+	} else if hp.Name != "three" {
+		t.Errorf("Expected 'three', got %v", hp.Name)
+	}
+	if n := rec.count("datastore_v3.Get"); n != 0 {
+		t.Errorf("Expected no datastore Get RPCs, got %v", n)
+	}
+}
+
+func TestRunCaches(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	const total = 50
+	parent := datastore.NewKey(c, "RunParent", "", 1, nil)
+	items := make([]*HasParent, total)
+	for i := range items {
+		items[i] = &HasParent{Id: int64(i + 1), P: parent, Name: "run"}
+	}
+	if _, err := g.PutMulti(items); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+	memcache.Flush(c)
+
+	it := g.Run(datastore.NewQuery("HasParent").Ancestor(parent))
+	for n := 1; ; n++ {
+		hp := &HasParent{}
+		key, err := it.Next(hp)
+		if err == datastore.Done {
+			if n-1 != total {
+				t.Errorf("Expected %v results, got %v", total, n-1)
+			}
+			break
+		} else if err != nil {
+			t.Fatalf("Unexpected error on Next - %v", err)
+		}
+
+		g.cacheLock.RLock()
+		cached := len(g.cache)
+		_, present := g.cache[memkey(key)]
+		g.cacheLock.RUnlock()
+		if !present || cached != n {
+			t.Errorf("Expected %v entities in the local cache after %v results, got %v", n, n, cached)
+		}
+		if _, err := memcache.Get(c, memkey(key)); err != nil {
+			t.Errorf("Expected %v to be in memcache - %v", key, err)
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	parent := datastore.NewKey(c, "CountParent", "", 1, nil)
+	items := []*HasParent{{Id: 1, P: parent}, {Id: 2, P: parent}, {Id: 3, P: parent}}
+	if _, err := g.PutMulti(items); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	if n, err := g.Count(datastore.NewQuery("HasParent").Ancestor(parent)); err != nil {
+		t.Errorf("Unexpected error on Count - %v", err)
+	} else if n != len(items) {
+		t.Errorf("Expected %v, got %v", len(items), n)
+	}
+}
+
+// TestConcurrentCache is most useful when run with the -race flag.
+func TestConcurrentCache(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	var wg sync.WaitGroup
+	for x := 1; x <= 20; x++ {
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+			if _, err := g.Put(&HasId{Id: id, Name: "concurrent"}); err != nil {
+				t.Errorf("Unexpected error on Put of %v - %v", id, err)
+				return
+			}
+			hid := &HasId{Id: id}
+			if err := g.Get(hid); err != nil {
+				t.Errorf("Unexpected error on Get of %v - %v", id, err)
+			} else if hid.Name != "concurrent" {
+				t.Errorf("Expected 'concurrent', got %v", hid.Name)
+			}
+			if err := g.Delete(g.Key(hid)); err != nil {
+				t.Errorf("Unexpected error on Delete of %v - %v", id, err)
+			}
+			if err := g.Get(&HasId{Id: id}); err != datastore.ErrNoSuchEntity {
+				t.Errorf("Expected ErrNoSuchEntity for %v, got %v", id, err)
+			}
+		}(int64(x))
+	}
+	wg.Wait()
+}
+
+func TestFlushLocalCache(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+
+	items := []*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}, {Id: 3, Name: "three"}}
+	if _, err := g.PutMulti(items); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+
+	g.FlushLocalCache()
+	g.cacheLock.RLock()
+	cached := len(g.cache)
+	g.cacheLock.RUnlock()
+	if cached != 0 {
+		t.Errorf("Expected an empty local cache, got %v entries", cached)
+	}
+
+	rec.reset()
+	hid := &HasId{Id: 2}
+	if err := g.Get(hid); err != nil {
+		t.Errorf("Unexpected error on Get - %v", err)
+	} else if hid.Name != "two" {
+		t.Errorf("Expected 'two', got %v", hid.Name)
+	}
+	if rec.count("memcache.Get") != 1 || rec.count("datastore_v3.Get") != 1 {
+		t.Errorf("Expected a memcache and datastore fetch after flushing, got %v", rec.calls)
+	}
+}
+
+func TestMemcacheExpiration(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	hid := &HasId{Id: 1, Name: "expiring"}
+	if items, _, _, err := g.memcacheItems([]interface{}{hid}, []byte{1}); err != nil {
+		t.Fatalf("Unexpected error on memcacheItems - %v", err)
+	} else if items[0].Expiration != 0 {
+		t.Errorf("Expected no expiration by default, got %v", items[0].Expiration)
+	}
+
+	g.MemcacheExpiration = time.Second
+	if items, _, _, err := g.memcacheItems([]interface{}{hid}, []byte{1}); err != nil {
+		t.Fatalf("Unexpected error on memcacheItems - %v", err)
+	} else if items[0].Expiration != time.Second {
+		t.Errorf("Expected an expiration of %v, got %v", time.Second, items[0].Expiration)
+	}
+
+	// Populate memcache via a Get and wait for the item to expire
+	if _, err := g.Put(hid); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	g.FlushLocalCache()
+	if err := g.Get(&HasId{Id: 1}); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	if _, err := memcache.Get(c, memkey(g.Key(hid))); err != nil {
+		t.Fatalf("Expected the entity to be in memcache - %v", err)
+	}
+	time.Sleep(2 * time.Second)
+	if _, err := memcache.Get(c, memkey(g.Key(hid))); err != memcache.ErrCacheMiss {
+		t.Errorf("Expected the memcache item to have expired, got %v", err)
+	}
+}
+
+func TestDisableMemcache(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+	g.DisableMemcache = true
+
+	items := []*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}}
+	if _, err := g.PutMulti(items); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+	hids := []*HasId{{Id: 1}, {Id: 2}, {Id: 3}}
+	if err := g.GetMulti(hids); !NotFound(err, 2) {
+		t.Fatalf("Expected a not found error for the third entity, got %v", err)
+	} else if hids[0].Name != "one" || hids[1].Name != "two" {
+		t.Errorf("Unexpected GetMulti results - %v, %v", hids[0], hids[1])
+	}
+	// The local cache is still in use
+	if err := g.Get(&HasId{Id: 1}); err != nil {
+		t.Errorf("Unexpected error on Get - %v", err)
+	}
+	if err := g.RunInTransaction(func(tg *Goon) error {
+		_, err := tg.Put(&HasId{Id: 4})
+		return err
+	}, nil); err != nil {
+		t.Errorf("Unexpected error on transaction - %v", err)
+	}
+	if err := g.DeleteMulti([]*datastore.Key{g.Key(items[0]), g.Key(items[1])}); err != nil {
+		t.Errorf("Unexpected error on DeleteMulti - %v", err)
+	}
+
+	if n := rec.count("datastore_v3.Get"); n != 1 {
+		t.Errorf("Expected 1 datastore Get, got %v", n)
+	}
+	for _, call := range rec.calls {
+		if strings.HasPrefix(call, "memcache.") {
+			t.Errorf("Expected no memcache RPCs, got %v", call)
+		}
+	}
+}
+
+func TestMemcacheGetError(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	items := []*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}, {Id: 3, Name: "three"}}
+	if _, err := g.PutMulti(items); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+	// Get one of the entities into memcache, so a working memcache would return a partial result
+	if err := g.Get(&HasId{Id: 1}); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	g.FlushLocalCache()
+
+	// Emulate a memcache outage
+	g.Context = appengine.WithAPICallFunc(c, func(ctx context.Context, service, method string, in, out proto.Message) error {
+		if service == "memcache" {
+			return errors.New("memcache is down")
+		}
+		return appengine.APICall(ctx, service, method, in, out)
+	})
+
+	hids := []*HasId{{Id: 1}, {Id: 2}, {Id: 3}}
+	if err := g.GetMulti(hids); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+	for i, hid := range hids {
+		if hid.Name != items[i].Name {
+			t.Errorf("Expected %v, got %v", items[i].Name, hid.Name)
+		}
+	}
+}
+
+func TestCacheMisses(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+	g.CacheMisses = true
+
+	for i := 0; i < 2; i++ {
+		if err := g.Get(&HasId{Id: 1}); err != datastore.ErrNoSuchEntity {
+			t.Errorf("Expected ErrNoSuchEntity, got %v", err)
+		}
+	}
+	if n := rec.count("datastore_v3.Get"); n != 1 {
+		t.Errorf("Expected 1 datastore Get, got %v", n)
+	}
+	if n := rec.count("memcache.Get"); n != 1 {
+		t.Errorf("Expected 1 memcache Get, got %v", n)
+	}
+
+	// A Put must clear the cached miss
+	if _, err := g.Put(&HasId{Id: 1, Name: "one"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	hid := &HasId{Id: 1}
+	if err := g.Get(hid); err != nil {
+		t.Errorf("Unexpected error on Get - %v", err)
+	} else if hid.Name != "one" {
+		t.Errorf("Expected 'one', got %v", hid.Name)
+	}
+
+	// A Delete followed by a Get caches the miss again
+	if err := g.Delete(g.Key(hid)); err != nil {
+		t.Fatalf("Unexpected error on Delete - %v", err)
+	}
+	rec.reset()
+	for i := 0; i < 2; i++ {
+		if err := g.Get(&HasId{Id: 1}); err != datastore.ErrNoSuchEntity {
+			t.Errorf("Expected ErrNoSuchEntity, got %v", err)
+		}
+	}
+	if n := rec.count("datastore_v3.Get"); n != 1 {
+		t.Errorf("Expected 1 datastore Get, got %v", n)
+	}
+
+	// Misses served from memcache are cached locally as well
+	g.FlushLocalCache()
+	rec.reset()
+	for i := 0; i < 2; i++ {
+		if err := g.Get(&HasId{Id: 1}); err != datastore.ErrNoSuchEntity {
+			t.Errorf("Expected ErrNoSuchEntity, got %v", err)
+		}
+	}
+	if len(rec.calls) != 1 || rec.count("memcache.Get") != 1 {
+		t.Errorf("Expected a single memcache Get, got %v", rec.calls)
+	}
+}
+
+func TestExists(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	items := []*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}, {Id: 3, Name: "three"}}
+	if _, err := g.PutMulti(items); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+	// 1 is in memcache, 2 is in the local cache, 3 is only in the datastore
+	if err := g.Get(&HasId{Id: 1}); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	g.FlushLocalCache()
+	if err := g.Get(&HasId{Id: 2}); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	// 4 is a cached miss, 5 has never been seen
+	if err := g.Get(&HasId{Id: 4}); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("Expected ErrNoSuchEntity, got %v", err)
+	}
+
+	check := func(g *Goon, prettyInfo string) {
+		exists, err := g.ExistsMulti([]*HasId{{Id: 1}, {Id: 2}, {Id: 3}, {Id: 4}, {Id: 5}})
+		if err != nil {
+			t.Fatalf("%v > Unexpected error on ExistsMulti - %v", prettyInfo, err)
+		}
+		expected := []bool{true, true, true, false, false}
+		if !reflect.DeepEqual(exists, expected) {
+			t.Errorf("%v > Expected %v, got %v", prettyInfo, expected, exists)
+		}
+		if ok, err := g.Exists(&HasId{Id: 3}); err != nil || !ok {
+			t.Errorf("%v > Expected 3 to exist, got %v, %v", prettyInfo, ok, err)
+		}
+		if ok, err := g.Exists(&HasId{Id: 5}); err != nil || ok {
+			t.Errorf("%v > Expected 5 not to exist, got %v, %v", prettyInfo, ok, err)
+		}
+	}
+	check(g, "Cached")
+	if err := g.RunInTransaction(func(tg *Goon) error {
+		check(tg, "TXN")
+		return nil
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		t.Errorf("Unexpected error on transaction - %v", err)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+
+	ca, err := appengine.Namespace(c, "A")
+	if err != nil {
+		t.Fatalf("Unexpected error on Namespace - %v", err)
+	}
+	cb, err := appengine.Namespace(c, "B")
+	if err != nil {
+		t.Fatalf("Unexpected error on Namespace - %v", err)
+	}
+	ga, gb := FromContext(ca), FromContext(cb)
+
+	if _, err := ga.Put(&HasString{Id: "same", Name: "A"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if _, err := gb.Put(&HasString{Id: "same", Name: "B"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if memkey(ga.Key(&HasString{Id: "same"})) == memkey(gb.Key(&HasString{Id: "same"})) {
+		t.Errorf("Expected different cache keys for different namespaces")
+	}
+
+	// Populate memcache from both namespaces, then read back from memcache only
+	for pass := 0; pass < 2; pass++ {
+		ga.FlushLocalCache()
+		gb.FlushLocalCache()
+		ha, hb := &HasString{Id: "same"}, &HasString{Id: "same"}
+		if err := ga.Get(ha); err != nil {
+			t.Errorf("Unexpected error on Get - %v", err)
+		} else if ha.Name != "A" {
+			t.Errorf("Expected 'A', got %v", ha.Name)
+		}
+		if err := gb.Get(hb); err != nil {
+			t.Errorf("Unexpected error on Get - %v", err)
+		} else if hb.Name != "B" {
+			t.Errorf("Expected 'B', got %v", hb.Name)
+		}
+	}
+}
+
+func TestGetMultiBatches(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	// Only every third entity exists
+	const total = 3000
+	var puts []*HasId
+	for x := 1; x <= total; x += 3 {
+		puts = append(puts, &HasId{Id: int64(x), Name: fmt.Sprint(x)})
+	}
+	if _, err := g.PutMulti(puts); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+	// Put a few entities into memcache, so the datastore indices don't match the dst indices
+	if err := g.GetMulti(puts[:50]); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+	g.FlushLocalCache()
+
+	gets := make([]*HasId, total)
+	for x := range gets {
+		gets[x] = &HasId{Id: int64(x + 1)}
+	}
+	err = g.GetMulti(gets)
+	merr, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatalf("Expected a MultiError, got %v", err)
+	}
+	for x, hid := range gets {
+		if x%3 == 0 {
+			if merr[x] != nil {
+				t.Errorf("Unexpected error for %v - %v", x+1, merr[x])
+			} else if hid.Name != fmt.Sprint(x+1) {
+				t.Errorf("Expected %v, got %v", x+1, hid.Name)
+			}
+		} else if merr[x] != datastore.ErrNoSuchEntity {
+			t.Errorf("Expected ErrNoSuchEntity for %v, got %v", x+1, merr[x])
+		}
+	}
+
+	// A failing datastore must only report errors for the keys fetched from it
+	g.FlushLocalCache()
+	dsErr := errors.New("datastore is down")
+	g.Context = appengine.WithAPICallFunc(c, func(ctx context.Context, service, method string, in, out proto.Message) error {
+		if service == "datastore_v3" {
+			return dsErr
+		}
+		return appengine.APICall(ctx, service, method, in, out)
+	})
+	gets = make([]*HasId, 300)
+	for x := range gets {
+		gets[x] = &HasId{Id: int64(x*3 + 1)}
+	}
+	err = g.GetMulti(gets)
+	merr, ok = err.(appengine.MultiError)
+	if !ok {
+		t.Fatalf("Expected a MultiError, got %v", err)
+	}
+	for x := range gets {
+		if x < 50 && merr[x] != nil {
+			t.Errorf("Unexpected error for memcached entity %v - %v", gets[x].Id, merr[x])
+		} else if x >= 50 && merr[x] != dsErr {
+			t.Errorf("Expected the datastore error for %v, got %v", gets[x].Id, merr[x])
+		}
+	}
+}
+
+func TestPutMultiBatches(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	const total = 1500
+	items := make([]*HasId, total)
+	for x := range items {
+		items[x] = &HasId{Name: fmt.Sprint(x)}
+	}
+	keys, err := g.PutMulti(items)
+	if err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	ids := make(map[int64]bool, total)
+	for x, item := range items {
+		if item.Id == 0 {
+			t.Errorf("Item %v did not get an id", x)
+			continue
+		}
+		if ids[item.Id] {
+			t.Errorf("Item %v got a duplicate id %v", x, item.Id)
+		}
+		ids[item.Id] = true
+		if keys[x].IntID() != item.Id {
+			t.Errorf("Key %v doesn't match item %v id %v", keys[x], x, item.Id)
+		}
+	}
+
+	g.FlushLocalCache()
+	gets := make([]*HasId, total)
+	for x, item := range items {
+		gets[x] = &HasId{Id: item.Id}
+	}
+	if err := g.GetMulti(gets); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+	for x, hid := range gets {
+		if hid.Name != fmt.Sprint(x) {
+			t.Errorf("Expected %v, got %v", x, hid.Name)
+		}
+	}
+}
+
+// Regression test for generated keys being written to the wrong index of the
+// returned slice once a PutMulti spans more than one batch.
+func TestPutMultiIncompleteKeys(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	items := make([]HasId, putMultiLimit+100)
+	keys, err := g.PutMulti(&items)
+	if err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	if len(keys) != len(items) {
+		t.Fatalf("Expected %v keys, got %v", len(items), len(keys))
+	}
+	seen := make(map[string]bool, len(keys))
+	for x, key := range keys {
+		if key.Incomplete() {
+			t.Errorf("Key %v is incomplete", x)
+			continue
+		}
+		if seen[key.String()] {
+			t.Errorf("Key %v is a duplicate - %v", x, key)
+		}
+		seen[key.String()] = true
+		if key.IntID() != items[x].Id {
+			t.Errorf("Key %v doesn't match item id %v", key, items[x].Id)
+		}
+	}
+}
+
+type fakeTimeoutError struct{}
+
+func (fakeTimeoutError) Error() string   { return "fake timeout" }
+func (fakeTimeoutError) IsTimeout() bool { return true }
+
+func TestRetry(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+	g.DisableMemcache = true
+	g.RetryAttempts = 3
+	g.RetryBackoff = time.Millisecond
+
+	// Emulate a datastore that times out twice on each call, then succeeds
+	var lock sync.Mutex
+	calls := make(map[string]int)
+	g.Context = appengine.WithAPICallFunc(c, func(ctx context.Context, service, method string, in, out proto.Message) error {
+		if service == "datastore_v3" {
+			lock.Lock()
+			calls[method]++
+			n := calls[method]
+			lock.Unlock()
+			if n <= 2 {
+				return fakeTimeoutError{}
+			}
+		}
+		return appengine.APICall(ctx, service, method, in, out)
+	})
+
+	if _, err := g.Put(&HasId{Id: 1, Name: "one"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	g.FlushLocalCache()
+	hid := &HasId{Id: 1}
+	if err := g.Get(hid); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	} else if hid.Name != "one" {
+		t.Errorf("Expected one, got %v", hid.Name)
+	}
+	if err := g.Delete(g.Key(hid)); err != nil {
+		t.Fatalf("Unexpected error on Delete - %v", err)
+	}
+	for _, method := range []string{"Put", "Get", "Delete"} {
+		if calls[method] != 3 {
+			t.Errorf("Expected 3 %v calls, got %v", method, calls[method])
+		}
+	}
+
+	// Non-transient errors must not be retried
+	g.FlushLocalCache()
+	if err := g.Get(&HasId{Id: 1}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Expected ErrNoSuchEntity, got %v", err)
+	}
+	if calls["Get"] != 4 {
+		t.Errorf("Expected 4 Get calls, got %v", calls["Get"])
+	}
+
+	// Give up after RetryAttempts
+	g.RetryAttempts = 2
+	calls["Put"] = 0
+	if _, err := g.Put(&HasId{Id: 2}); !appengine.IsTimeoutError(err) {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+	if calls["Put"] != 2 {
+		t.Errorf("Expected 2 Put calls, got %v", calls["Put"])
+	}
+}
+
+func TestAllocateIDs(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	keys, err := g.AllocateIDs("HasId", nil, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error on AllocateIDs - %v", err)
+	}
+	if len(keys) != 10 {
+		t.Fatalf("Expected 10 keys, got %v", len(keys))
+	}
+	seen := make(map[int64]bool)
+	items := make([]*HasId, len(keys))
+	for i, key := range keys {
+		if key.Incomplete() {
+			t.Errorf("Key %v is incomplete", key)
+		}
+		if key.Kind() != "HasId" {
+			t.Errorf("Expected kind HasId, got %v", key.Kind())
+		}
+		if seen[key.IntID()] {
+			t.Errorf("Duplicate ID %v", key.IntID())
+		}
+		seen[key.IntID()] = true
+		items[i] = &HasId{Id: key.IntID()}
+	}
+	putKeys, err := g.PutMulti(items)
+	if err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	for i := range keys {
+		if !putKeys[i].Equal(keys[i]) {
+			t.Errorf("Expected %v, got %v", keys[i], putKeys[i])
+		}
+	}
+
+	if _, err := g.AllocateIDs("", nil, 1); err == nil {
+		t.Errorf("Expected error on AllocateIDs with an empty kind")
+	}
+}
+
+// PLSItem stores its Value with a prefix, and records whether Load was called.
+type PLSItem struct {
+	Id     int64 `datastore:"-" goon:"id"`
+	Value  string
+	Loaded bool
+}
+
+func (p *PLSItem) Save() ([]datastore.Property, error) {
+	return []datastore.Property{{Name: "Stored", Value: "saved:" + p.Value}}, nil
+}
+
+func (p *PLSItem) Load(props []datastore.Property) error {
+	for _, prop := range props {
+		if prop.Name == "Stored" {
+			p.Value = strings.TrimPrefix(prop.Value.(string), "saved:")
+		}
+	}
+	p.Loaded = true
+	return nil
+}
+
+func TestPropertyLoadSaverCache(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+
+	if _, err := g.Put(&PLSItem{Id: 1, Value: "one"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	// Fill memcache from the datastore
+	g.FlushLocalCache()
+	if err := g.Get(&PLSItem{Id: 1}); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+
+	g.FlushLocalCache()
+	rec.reset()
+	item := &PLSItem{Id: 1}
+	if err := g.Get(item); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	if n := rec.count("datastore_v3.Get"); n != 0 {
+		t.Errorf("Expected the Get to be served by memcache, got %v datastore Gets", n)
+	}
+	if !item.Loaded {
+		t.Errorf("Expected Load to be called on a memcache hit")
+	}
+	if item.Value != "one" {
+		t.Errorf("Expected one, got %v", item.Value)
+	}
+
+	// The serialized properties round trip directly too
+	b, err := serializeStruct(&PLSItem{Id: 2, Value: "two"})
+	if err != nil {
+		t.Fatalf("Unexpected error on serializeStruct - %v", err)
+	}
+	item = &PLSItem{}
+	if err := deserializeStruct(item, b); err != nil {
+		t.Fatalf("Unexpected error on deserializeStruct - %v", err)
+	}
+	if !item.Loaded || item.Value != "two" {
+		t.Errorf("Expected a loaded two, got %+v", item)
+	}
+}
+
+// PLSBytes saves its Data as a ByteString and its Tag in a nested entity.
+type PLSBytes struct {
+	Id   int64 `datastore:"-" goon:"id"`
+	Data []byte
+	Tag  string
+}
+
+func (p *PLSBytes) Save() ([]datastore.Property, error) {
+	return []datastore.Property{
+		{Name: "Data", Value: datastore.ByteString(p.Data)},
+		{Name: "Nested", Value: &datastore.Entity{Properties: []datastore.Property{{Name: "Tag", Value: p.Tag}}}},
+	}, nil
+}
+
+func (p *PLSBytes) Load(props []datastore.Property) error {
+	for _, prop := range props {
+		switch prop.Name {
+		case "Data":
+			p.Data = prop.Value.(datastore.ByteString)
+		case "Nested":
+			p.Tag = prop.Value.(*datastore.Entity).Properties[0].Value.(string)
+		}
+	}
+	return nil
+}
+
+func TestPropertyLoadSaverTypes(t *testing.T) {
+	// Every type a property can hold can be cached
+	b, err := serializeStruct(&PLSBytes{Id: 1, Data: []byte("data"), Tag: "tag"})
+	if err != nil {
+		t.Fatalf("Unexpected error on serializeStruct - %v", err)
+	}
+	item := &PLSBytes{}
+	if err := deserializeStruct(item, b); err != nil {
+		t.Fatalf("Unexpected error on deserializeStruct - %v", err)
+	}
+	if string(item.Data) != "data" || item.Tag != "tag" {
+		t.Errorf("Expected data and tag, got %+v", item)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+
+	codecs := []struct {
+		name  string
+		codec *memcache.Codec
+	}{
+		{"default", nil},
+		{"JSON", &memcache.JSON},
+		{"Gob", &memcache.Gob},
+	}
+	for i, tc := range codecs {
+		g := FromContext(c)
+		rec := &rpcRecorder{}
+		g.Context = rec.wrap(c)
+		g.Codec = tc.codec
+
+		id := int64(i + 1)
+		if _, err := g.Put(&HasId{Id: id, Name: tc.name}); err != nil {
+			t.Fatalf("%v: Unexpected error on Put - %v", tc.name, err)
+		}
+		// Fill memcache from the datastore
+		g.FlushLocalCache()
+		if err := g.Get(&HasId{Id: id}); err != nil {
+			t.Fatalf("%v: Unexpected error on Get - %v", tc.name, err)
+		}
+
+		item, err := memcache.Get(c, memkey(g.Key(&HasId{Id: id})))
+		if err != nil {
+			t.Fatalf("%v: Unexpected error on memcache.Get - %v", tc.name, err)
+		}
+		if tc.name == "JSON" && !bytes.HasPrefix(item.Value[1:], []byte("{")) {
+			t.Errorf("%v: Expected a JSON object in memcache, got %q", tc.name, item.Value)
+		}
+
+		g.FlushLocalCache()
+		rec.reset()
+		hid := &HasId{Id: id}
+		if err := g.Get(hid); err != nil {
+			t.Fatalf("%v: Unexpected error on Get - %v", tc.name, err)
+		}
+		if n := rec.count("datastore_v3.Get"); n != 0 {
+			t.Errorf("%v: Expected the Get to be served by memcache, got %v datastore Gets", tc.name, n)
+		}
+		if hid.Name != tc.name {
+			t.Errorf("%v: Expected %v, got %v", tc.name, tc.name, hid.Name)
+		}
+	}
+}
+
+func TestCorruptMemcacheValue(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	items := []*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}}
+	if _, err := g.PutMulti(items); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+	badKey := memkey(g.Key(items[0]))
+	// CacheGet can't fall back to the datastore, so it must evict the bad value itself
+	if err := memcache.Set(c, &memcache.Item{Key: badKey, Value: append([]byte{serializationStateNormal}, "Name|\xff\xfe"...)}); err != nil {
+		t.Fatalf("Unexpected error on memcache.Set - %v", err)
+	}
+	if found, err := g.CacheGet(&HasId{Id: 1}); found || err != nil {
+		t.Fatalf("Expected CacheGet to miss, got %v, %v", found, err)
+	}
+	if _, err := memcache.Get(c, badKey); err != memcache.ErrCacheMiss {
+		t.Errorf("Expected the corrupt memcache value to be evicted by CacheGet, got %v", err)
+	}
+	for _, value := range [][]byte{
+		append([]byte{serializationStateNormal}, "Removed|"...),      // a field the struct no longer has
+		append([]byte{serializationStateNormal}, "Name|\xff\xfe"...), // garbage data
+		{0x7f},                         // unknown header
+		{serializationStateCodec, '{'}, // written with a codec that isn't in use
+	} {
+		if err := memcache.Set(c, &memcache.Item{Key: badKey, Value: value}); err != nil {
+			t.Fatalf("Unexpected error on memcache.Set - %v", err)
+		}
+		hids := []*HasId{{Id: 1}, {Id: 2}}
+		if err := g.GetMulti(hids); err != nil {
+			t.Fatalf("Unexpected error on GetMulti - %v", err)
+		}
+		for i, hid := range hids {
+			if hid.Name != items[i].Name {
+				t.Errorf("Expected %v, got %v", items[i].Name, hid.Name)
+			}
+		}
+		// The bad value must have been replaced by the datastore value
+		item, err := memcache.Get(c, badKey)
+		if err != nil {
+			t.Fatalf("Unexpected error on memcache.Get - %v", err)
+		}
+		if bytes.Equal(item.Value, value) {
+			t.Errorf("Expected the corrupt memcache value to be evicted")
+		}
+		g.FlushLocalCache()
+	}
+}
+
+func TestDeserializeEmptyMetaData(t *testing.T) {
+	// An empty field name in the metadata must be an error, not a panic
+	for _, b := range [][]byte{
+		{serializationStateNormal, '|'},
+		append([]byte{serializationStateNormal}, "+Name|"...),
+		append([]byte{serializationStateNormal}, "Name|\xff\xfe"...), // garbage data breaks the decoder
+	} {
+		if err := deserializeStruct(&HasId{}, b); err == nil {
+			t.Errorf("Expected an error deserializing %q", b)
+		}
+	}
+	// The decoders returned to the pool after the errors must still work
+	data, err := serializeStruct(&HasId{Id: 1, Name: "one"})
+	if err != nil {
+		t.Fatalf("Unexpected error on serializeStruct - %v", err)
+	}
+	hid := &HasId{}
+	if err := deserializeStruct(hid, data); err != nil {
+		t.Fatalf("Unexpected error on deserializeStruct - %v", err)
+	}
+	if hid.Name != "one" {
+		t.Errorf("Expected one, got %v", hid.Name)
+	}
+}
+
+func TestMultiLimits(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+	g.DisableMemcache = true
+	g.GetMultiLimit = 2
+	g.PutMultiLimit = 3
+	g.DeleteMultiLimit = 4
+
+	items := make([]*HasId, 7)
+	for i := range items {
+		items[i] = &HasId{Id: int64(i + 1), Name: fmt.Sprint(i)}
+	}
+	keys, err := g.PutMulti(items)
+	if err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	if n := rec.count("datastore_v3.Put"); n != 3 {
+		t.Errorf("Expected 3 datastore Puts, got %v", n)
+	}
+
+	g.FlushLocalCache()
+	gets := make([]*HasId, len(items))
+	for i := range gets {
+		gets[i] = &HasId{Id: int64(i + 1)}
+	}
+	if err := g.GetMulti(gets); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+	if n := rec.count("datastore_v3.Get"); n != 4 {
+		t.Errorf("Expected 4 datastore Gets, got %v", n)
+	}
+	for i, hid := range gets {
+		if hid.Name != items[i].Name {
+			t.Errorf("Expected %v, got %v", items[i].Name, hid.Name)
+		}
+	}
+
+	if err := g.DeleteMulti(keys); err != nil {
+		t.Fatalf("Unexpected error on DeleteMulti - %v", err)
+	}
+	if n := rec.count("datastore_v3.Delete"); n != 2 {
+		t.Errorf("Expected 2 datastore Deletes, got %v", n)
+	}
+}
+
+func TestSetTesting(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	var lock sync.Mutex
+	var delays []time.Duration
+	g.sleep = func(d time.Duration) {
+		lock.Lock()
+		delays = append(delays, d)
+		lock.Unlock()
+	}
+
+	if _, err := g.Put(&HasId{Id: 1}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if len(delays) != 0 {
+		t.Errorf("Expected no delays outside of testing mode, got %v", len(delays))
+	}
+
+	g.SetTesting(true)
+	if _, err := g.Put(&HasId{Id: 2}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	g.FlushLocalCache()
+	if err := g.Get(&HasId{Id: 2}); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	// datastore Put, memcache Delete, memcache Get, datastore Get and memcache Set
+	if len(delays) != 5 {
+		t.Errorf("Expected 5 delays in testing mode, got %v", len(delays))
+	}
+	for _, d := range delays {
+		if d < 0 || d >= TestingMaxDelay {
+			t.Errorf("Expected a delay below %v, got %v", TestingMaxDelay, d)
+		}
+	}
+
+	g.SetTesting(false)
+	delays = nil
+	if err := g.Delete(g.Key(&HasId{Id: 2})); err != nil {
+		t.Fatalf("Unexpected error on Delete - %v", err)
+	}
+	if len(delays) != 0 {
+		t.Errorf("Expected no delays after leaving testing mode, got %v", len(delays))
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	var lock sync.Mutex
+	var handled []error
+	g.ErrorHandler = func(hc context.Context, err error) {
+		if hc != g.Context {
+			t.Errorf("Expected the handler to get the Goon's context")
+		}
+		lock.Lock()
+		handled = append(handled, err)
+		lock.Unlock()
+	}
+
+	// Emulate a datastore outage
+	putErr := errors.New("datastore is down")
+	g.Context = appengine.WithAPICallFunc(c, func(ctx context.Context, service, method string, in, out proto.Message) error {
+		if service == "datastore_v3" {
+			return putErr
+		}
+		return appengine.APICall(ctx, service, method, in, out)
+	})
+
+	if _, err := g.Put(&HasId{Id: 1}); err != putErr {
+		t.Fatalf("Expected %v, got %v", putErr, err)
+	}
+	if len(handled) != 1 || handled[0] != putErr {
+		t.Errorf("Expected the handler to receive exactly %v, got %v", putErr, handled)
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+	g.WriteThrough = true
+
+	items := []*HasId{{Id: 1, Name: "one"}, {Name: "incomplete"}}
+	if _, err := g.PutMulti(items); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	if n := rec.count("memcache.Delete"); n != 0 {
+		t.Errorf("Expected no memcache Deletes, got %v", n)
+	}
+	if n := rec.count("memcache.Set"); n != 1 {
+		t.Errorf("Expected 1 memcache Set, got %v", n)
+	}
+
+	g.FlushLocalCache()
+	rec.reset()
+	gets := []*HasId{{Id: 1}, {Id: items[1].Id}}
+	if err := g.GetMulti(gets); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+	if n := rec.count("datastore_v3.Get"); n != 0 {
+		t.Errorf("Expected the Get to be served by memcache, got %v datastore Gets", n)
+	}
+	for i, hid := range gets {
+		if hid.Name != items[i].Name {
+			t.Errorf("Expected %v, got %v", items[i].Name, hid.Name)
+		}
+	}
+
+	// Overwriting replaces the memcache entry
+	if _, err := g.Put(&HasId{Id: 1, Name: "uno"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	g.FlushLocalCache()
+	hid := &HasId{Id: 1}
+	if err := g.Get(hid); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	} else if hid.Name != "uno" {
+		t.Errorf("Expected uno, got %v", hid.Name)
+	}
+}
+
+func TestGetMultiMixedKinds(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+
+	if _, err := g.PutMulti([]interface{}{&HasId{Id: 1, Name: "one"}, &HasString{Id: "a", Name: "A"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+
+	check := func(src string, dsGets int) {
+		g.FlushLocalCache()
+		rec.reset()
+		dst := []interface{}{&HasId{Id: 1}, &HasString{Id: "a"}}
+		if err := g.GetMulti(&dst); err != nil {
+			t.Fatalf("%v: Unexpected error on GetMulti - %v", src, err)
+		}
+		if n := rec.count("datastore_v3.Get"); n != dsGets {
+			t.Errorf("%v: Expected %v datastore Gets, got %v", src, dsGets, n)
+		}
+		if hid := dst[0].(*HasId); hid.Name != "one" {
+			t.Errorf("%v: Expected one, got %v", src, hid.Name)
+		}
+		if hs := dst[1].(*HasString); hs.Name != "A" {
+			t.Errorf("%v: Expected A, got %v", src, hs.Name)
+		}
+		// The local cache keeps each element's type
+		if _, ok := g.cache[memkey(g.Key(dst[0]))].(*HasId); !ok {
+			t.Errorf("%v: Expected a *HasId in the local cache, got %T", src, g.cache[memkey(g.Key(dst[0]))])
+		}
+		if _, ok := g.cache[memkey(g.Key(dst[1]))].(*HasString); !ok {
+			t.Errorf("%v: Expected a *HasString in the local cache, got %T", src, g.cache[memkey(g.Key(dst[1]))])
+		}
+	}
+	memcache.Flush(c)
+	check("datastore", 1)
+	check("memcache", 0)
+}
+
+func TestParentKey(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	grandparent := datastore.NewKey(c, "Root", "r", 0, nil)
+	parent := datastore.NewKey(c, "HasParent", "", 5, grandparent)
+	child := &HasParent{Id: 7, P: parent, Name: "child"}
+
+	key, err := g.KeyError(child)
+	if err != nil {
+		t.Fatalf("Unexpected error on KeyError - %v", err)
+	}
+	if !key.Parent().Equal(parent) {
+		t.Errorf("Expected parent %v, got %v", parent, key.Parent())
+	}
+	if !key.Parent().Parent().Equal(grandparent) {
+		t.Errorf("Expected grandparent %v, got %v", grandparent, key.Parent().Parent())
+	}
+
+	putKey, err := g.Put(child)
+	if err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if !putKey.Equal(key) {
+		t.Errorf("Expected %v, got %v", key, putKey)
+	}
+
+	// The same id under another parent is a different entity, also in the caches
+	orphan := &HasParent{Id: 7}
+	if memkey(g.Key(orphan)) == memkey(key) {
+		t.Errorf("Expected different memcache keys for different parents")
+	}
+	if err := g.Get(orphan); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Expected ErrNoSuchEntity, got %v", err)
+	}
+	g.FlushLocalCache()
+	got := &HasParent{Id: 7, P: parent}
+	if err := g.Get(got); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	} else if got.Name != "child" {
+		t.Errorf("Expected child, got %v", got.Name)
+	}
+}
+
+func TestGetOrInsert(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	// Freshly created
+	hid := &HasId{Id: 1, Name: "new"}
+	if err := g.GetOrInsert(hid); err != nil {
+		t.Fatalf("Unexpected error on GetOrInsert - %v", err)
+	} else if hid.Name != "new" {
+		t.Errorf("Expected new, got %v", hid.Name)
+	}
+	stored := &HasId{}
+	if err := datastore.Get(c, g.Key(hid), stored); err != nil {
+		t.Fatalf("Unexpected error on datastore.Get - %v", err)
+	} else if stored.Name != "new" {
+		t.Errorf("Expected new in the datastore, got %v", stored.Name)
+	}
+	// The committed entity is in the local cache
+	if cached, ok := g.cache[memkey(g.Key(hid))].(*HasId); !ok || cached.Name != "new" {
+		t.Errorf("Expected new in the local cache, got %v", g.cache[memkey(g.Key(hid))])
+	}
+
+	// Already exists
+	hid = &HasId{Id: 1, Name: "other"}
+	if err := g.GetOrInsert(hid); err != nil {
+		t.Fatalf("Unexpected error on GetOrInsert - %v", err)
+	} else if hid.Name != "new" {
+		t.Errorf("Expected new, got %v", hid.Name)
+	}
+
+	// Concurrent attempts, only one of which may insert
+	const attempts = 3
+	hids := make([]*HasId, attempts)
+	errs := make([]error, attempts)
+	var wg sync.WaitGroup
+	for i := range hids {
+		hids[i] = &HasId{Id: 2, Name: fmt.Sprint(i)}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = FromContext(c).GetOrInsert(hids[i])
+		}(i)
+	}
+	wg.Wait()
+	stored = &HasId{}
+	if err := datastore.Get(c, g.Key(hids[0]), stored); err != nil {
+		t.Fatalf("Unexpected error on datastore.Get - %v", err)
+	}
+	for i, err := range errs {
+		if err == datastore.ErrConcurrentTransaction {
+			continue // gave up on retrying, which is fine
+		} else if err != nil {
+			t.Errorf("Unexpected error on GetOrInsert - %v", err)
+		} else if hids[i].Name != stored.Name {
+			t.Errorf("Expected every caller to see %v, got %v", stored.Name, hids[i].Name)
+		}
+	}
+}
+
+type VersionedItem struct {
+	Id      int64 `datastore:"-" goon:"id"`
+	Version int64 `goon:"version"`
+	Name    string
+}
+
+func TestVersionConflict(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	item := &VersionedItem{Id: 1, Name: "one"}
+	if _, err := g.Put(item); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	} else if item.Version != 1 {
+		t.Errorf("Expected version 1, got %v", item.Version)
+	}
+	stale := *item
+	item.Name = "uno"
+	if _, err := g.Put(item); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	} else if item.Version != 2 {
+		t.Errorf("Expected version 2, got %v", item.Version)
+	}
+
+	// Saving an outdated version fails, and leaves the version alone
+	stale.Name = "lost update"
+	_, err = g.Put(&stale)
+	if verr, ok := err.(*ErrVersionConflict); !ok {
+		t.Fatalf("Expected ErrVersionConflict, got %v", err)
+	} else if verr.Version != 1 || verr.StoredVersion != 2 {
+		t.Errorf("Expected version 1 and stored version 2, got %+v", verr)
+	}
+	if stale.Version != 1 {
+		t.Errorf("Expected the version to be restored to 1, got %v", stale.Version)
+	}
+	stored := &VersionedItem{}
+	if err := datastore.Get(c, g.Key(item), stored); err != nil {
+		t.Fatalf("Unexpected error on datastore.Get - %v", err)
+	} else if stored.Name != "uno" || stored.Version != 2 {
+		t.Errorf("Expected uno at version 2, got %+v", stored)
+	}
+
+	// Two writers race to update the same version, only one may win
+	writers := []*VersionedItem{
+		{Id: 1, Version: 2, Name: "first"},
+		{Id: 1, Version: 2, Name: "second"},
+	}
+	errs := make([]error, len(writers))
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = FromContext(c).Put(writers[i])
+		}(i)
+	}
+	wg.Wait()
+	var winner *VersionedItem
+	for i, err := range errs {
+		if err == nil {
+			if winner != nil {
+				t.Errorf("Expected only one writer to succeed")
+			}
+			winner = writers[i]
+		} else if _, ok := err.(*ErrVersionConflict); !ok && err != datastore.ErrConcurrentTransaction {
+			t.Errorf("Unexpected error on Put - %v", err)
+		}
+	}
+	if winner == nil {
+		t.Fatalf("Expected one writer to succeed, got %v", errs)
+	}
+	stored = &VersionedItem{}
+	if err := datastore.Get(c, g.Key(item), stored); err != nil {
+		t.Fatalf("Unexpected error on datastore.Get - %v", err)
+	} else if stored.Name != winner.Name || stored.Version != 3 {
+		t.Errorf("Expected %v at version 3, got %+v", winner.Name, stored)
+	}
+}
+
+// mapEntity isn't a struct, e.g. a map based PropertyLoadSaver.
+type mapEntity map[string]string
+
+func TestTaggedFieldNotStruct(t *testing.T) {
+	if versions := entityVersions(reflect.ValueOf([]interface{}{mapEntity{}, (*HasId)(nil)})); versions != nil {
+		t.Errorf("Expected no versions, got %v", versions)
+	}
+}
+
+func TestVersionRollback(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	// A failed transaction leaves the version alone, so the entity can still be saved
+	item := &VersionedItem{Id: 1, Name: "one"}
+	errAbort := errors.New("abort")
+	if err := g.RunInTransaction(func(tg *Goon) error {
+		if _, err := tg.Put(item); err != nil {
+			return err
+		}
+		return errAbort
+	}, nil); err != errAbort {
+		t.Fatalf("Expected the transaction to fail with %v, got %v", errAbort, err)
+	}
+	if item.Version != 0 {
+		t.Errorf("Expected the version to be restored to 0, got %v", item.Version)
+	}
+	if _, err := g.Put(item); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	} else if item.Version != 1 {
+		t.Errorf("Expected version 1, got %v", item.Version)
+	}
+
+	// More entity groups than a single transaction may use
+	items := make([]*VersionedItem, maxEntityGroups+5)
+	for i := range items {
+		items[i] = &VersionedItem{Id: int64(i + 10), Name: "many"}
+	}
+	if _, err := g.PutMulti(items); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	for _, item := range items {
+		if item.Version != 1 {
+			t.Errorf("Expected version 1, got %v", item.Version)
+		}
+	}
+
+	// Saving the same entity twice in a transaction sees the first Put
+	item = &VersionedItem{Id: 2, Name: "two"}
+	if err := g.RunInTransaction(func(tg *Goon) error {
+		if _, err := tg.Put(item); err != nil {
+			return err
+		}
+		item.Name = "deux"
+		_, err := tg.Put(item)
+		return err
+	}, nil); err != nil {
+		t.Fatalf("Unexpected error on RunInTransaction - %v", err)
+	} else if item.Version != 2 {
+		t.Errorf("Expected version 2, got %v", item.Version)
+	}
+
+	// Keys are returned on errors, like for unversioned entities
+	stale := []*VersionedItem{{Id: 2, Version: 1}, {Id: 3}}
+	keys, err := g.PutMulti(stale)
+	if _, ok := err.(*ErrVersionConflict); !ok {
+		t.Fatalf("Expected ErrVersionConflict, got %v", err)
+	} else if len(keys) != 2 || !keys[0].Equal(g.Key(item)) {
+		t.Errorf("Expected the given keys, got %v", keys)
+	}
+}
+
+func TestCacheGet(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+
+	if _, err := g.Put(&HasId{Id: 1, Name: "one"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+
+	// Local cache hit
+	rec.reset()
+	hid := &HasId{Id: 1}
+	if ok, err := g.CacheGet(hid); err != nil || !ok {
+		t.Errorf("Expected a local cache hit, got %v, %v", ok, err)
+	} else if hid.Name != "one" {
+		t.Errorf("Expected one, got %v", hid.Name)
+	}
+	if n := rec.count("memcache.Get"); n != 0 {
+		t.Errorf("Expected no memcache Gets, got %v", n)
+	}
+
+	// Memcache hit
+	g.FlushLocalCache()
+	if err := g.Get(&HasId{Id: 1}); err != nil { // fills memcache
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	g.FlushLocalCache()
+	rec.reset()
+	hid = &HasId{Id: 1}
+	if ok, err := g.CacheGet(hid); err != nil || !ok {
+		t.Errorf("Expected a memcache hit, got %v, %v", ok, err)
+	} else if hid.Name != "one" {
+		t.Errorf("Expected one, got %v", hid.Name)
+	}
+	if n := rec.count("memcache.Get"); n != 1 {
+		t.Errorf("Expected 1 memcache Get, got %v", n)
+	}
+	if _, ok := g.cache[memkey(g.Key(hid))]; !ok {
+		t.Errorf("Expected the memcache hit to be cached locally")
+	}
+
+	// Total miss, the entity exists but isn't cached anywhere
+	g.FlushLocalCache()
+	memcache.Flush(c)
+	rec.reset()
+	hid = &HasId{Id: 1}
+	if ok, err := g.CacheGet(hid); err != nil || ok {
+		t.Errorf("Expected a miss, got %v, %v", ok, err)
+	} else if hid.Name != "" {
+		t.Errorf("Expected dst to be untouched, got %v", hid.Name)
+	}
+	if n := rec.count("datastore_v3.Get"); n != 0 {
+		t.Errorf("Expected no datastore Gets, got %v", n)
+	}
+
+	// A cached nonexistent entity
+	if err := g.Get(&HasId{Id: 2}); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("Expected ErrNoSuchEntity, got %v", err)
+	}
+	if ok, err := g.CacheGet(&HasId{Id: 2}); ok || err != datastore.ErrNoSuchEntity {
+		t.Errorf("Expected ErrNoSuchEntity, got %v, %v", ok, err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	items := []*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}}
+	if _, err := g.PutMulti(items); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	if s := g.Stats(); s != (Stats{}) {
+		t.Errorf("Expected no stats after a Put, got %+v", s)
+	}
+
+	// Both in the local cache
+	if err := g.GetMulti([]*HasId{{Id: 1}, {Id: 2}}); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+	// Both from the datastore, as Put doesn't fill memcache
+	g.FlushLocalCache()
+	if err := g.GetMulti([]*HasId{{Id: 1}, {Id: 2}}); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+	// One from memcache, and one missing that has to be looked up in the datastore
+	g.FlushLocalCache()
+	if err := g.GetMulti([]*HasId{{Id: 1}, {Id: 3}}); !NotFound(err, 1) {
+		t.Fatalf("Expected the second entity not to be found, got %v", err)
+	}
+
+	expected := Stats{
+		LocalHits:      2,
+		MemcacheHits:   1,
+		MemcacheMisses: 3,
+		DatastoreReads: 3,
+	}
+	if s := g.Stats(); s != expected {
+		t.Errorf("Expected %+v, got %+v", expected, s)
+	}
+}
+
+// OldHasId is HasId before a field was removed.
+type OldHasId struct {
+	Name    string
+	Removed string
+}
+
+func TestIgnoreFieldMismatch(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	key := datastore.NewKey(c, "HasId", "", 1, nil)
+	if _, err := datastore.Put(c, key, &OldHasId{Name: "one", Removed: "gone"}); err != nil {
+		t.Fatalf("Unexpected error on datastore.Put - %v", err)
+	}
+
+	if err := g.Get(&HasId{Id: 1}); err == nil {
+		t.Fatalf("Expected ErrFieldMismatch without IgnoreFieldMismatch")
+	} else if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+		t.Fatalf("Expected ErrFieldMismatch, got %v", err)
+	}
+
+	g = FromContext(c)
+	g.IgnoreFieldMismatch = true
+	hid := &HasId{Id: 1}
+	if err := g.Get(hid); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	} else if hid.Name != "one" {
+		t.Errorf("Expected one, got %v", hid.Name)
+	}
+	// The partially loaded entity is cached
+	if cached, ok := g.cache[memkey(key)].(*HasId); !ok || cached.Name != "one" {
+		t.Errorf("Expected one in the local cache, got %v", g.cache[memkey(key)])
+	}
+
+	if err := g.RunInTransaction(func(tg *Goon) error {
+		return tg.Get(&HasId{Id: 1})
+	}, nil); err != nil {
+		t.Errorf("Unexpected error on Get in a transaction - %v", err)
+	}
+}
+
+func TestLocalCacheLimit(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+	g.SetLocalCacheLimit(3)
+
+	for i := int64(1); i <= 3; i++ {
+		if _, err := g.Put(&HasId{Id: i}); err != nil {
+			t.Fatalf("Unexpected error on Put - %v", err)
+		}
+	}
+	// Use 1, so that 2 is the least recently used
+	if err := g.Get(&HasId{Id: 1}); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	for i := int64(4); i <= 5; i++ {
+		if _, err := g.Put(&HasId{Id: i}); err != nil {
+			t.Fatalf("Unexpected error on Put - %v", err)
+		}
+	}
+
+	if len(g.cache) != 3 {
+		t.Errorf("Expected 3 cached entities, got %v", len(g.cache))
+	}
+	for i, cached := range map[int64]bool{1: true, 2: false, 3: false, 4: true, 5: true} {
+		if _, ok := g.cache[memkey(g.Key(&HasId{Id: i}))]; ok != cached {
+			t.Errorf("Expected entity %v to be cached: %v, got %v", i, cached, ok)
+		}
+	}
+
+	// Deleted entities leave the cache, making room for others
+	if err := g.Delete(g.Key(&HasId{Id: 1})); err != nil {
+		t.Fatalf("Unexpected error on Delete - %v", err)
+	}
+	if err := g.Get(&HasId{Id: 3}); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	for i, cached := range map[int64]bool{3: true, 4: true, 5: true} {
+		if _, ok := g.cache[memkey(g.Key(&HasId{Id: i}))]; ok != cached {
+			t.Errorf("Expected entity %v to be cached: %v, got %v", i, cached, ok)
+		}
+	}
+
+	// Lowering the limit evicts right away, and no limit means unbounded
+	g.SetLocalCacheLimit(1)
+	if len(g.cache) != 1 {
+		t.Errorf("Expected 1 cached entity, got %v", len(g.cache))
+	}
+	g.SetLocalCacheLimit(0)
+	for i := int64(1); i <= 5; i++ {
+		if _, err := g.Put(&HasId{Id: i}); err != nil {
+			t.Fatalf("Unexpected error on Put - %v", err)
+		}
+	}
+	if len(g.cache) != 5 {
+		t.Errorf("Expected 5 cached entities, got %v", len(g.cache))
+	}
+}
+
+func TestGetMultiPartlyCached(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	if _, err := g.PutMulti([]*HasId{{Id: 1, Name: "one"}, {Id: 3, Name: "three"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	// Stored by another request, so not in g's local cache
+	if _, err := FromContext(c).Put(&HasId{Id: 2, Name: "two"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+
+	hids := []*HasId{{Id: 1}, {Id: 2}, {Id: 3}}
+	if err := g.GetMulti(hids); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+	for i, name := range []string{"one", "two", "three"} {
+		if hids[i].Name != name {
+			t.Errorf("Expected %v, got %v", name, hids[i].Name)
+		}
+	}
+	if s := g.Stats(); s.LocalHits != 2 || s.DatastoreReads+s.MemcacheHits != 1 {
+		t.Errorf("Expected 2 local hits and 1 other read, got %+v", s)
+	}
+
+	if err := g.GetMulti([]*HasId{}); err != nil {
+		t.Errorf("Unexpected error on an empty GetMulti - %v", err)
+	}
+}
+
+func TestStdContext(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+
+	sc, cancel := context.WithCancel(c)
+	g := FromContext(sc)
+	if _, err := g.Put(&HasId{Id: 1, Name: "one"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	g.FlushLocalCache()
+	hid := &HasId{Id: 1}
+	if err := g.Get(hid); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	} else if hid.Name != "one" {
+		t.Errorf("Expected one, got %v", hid.Name)
+	}
+
+	// RPCs respect the cancelation of the context
+	cancel()
+	if _, err := g.Put(&HasId{Id: 2}); err == nil {
+		t.Errorf("Expected an error on Put with a canceled context")
+	}
+}
+
+func TestDeleteManyAndBySrc(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	items := []*HasId{{Id: 1}, {Id: 2}, {Id: 3}}
+	keys, err := g.PutMulti(items)
+	if err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+
+	if err := g.DeleteMany(keys[0], keys[1]); err != nil {
+		t.Fatalf("Unexpected error on DeleteMany - %v", err)
+	}
+	if err := g.DeleteMany(); err != nil {
+		t.Errorf("Unexpected error on an empty DeleteMany - %v", err)
+	}
+	if err := g.DeleteBySrc(&HasId{Id: 3}); err != nil {
+		t.Fatalf("Unexpected error on DeleteBySrc - %v", err)
+	}
+	if err := g.DeleteBySrc(&HasId{}); err != datastore.ErrInvalidKey {
+		t.Errorf("Expected ErrInvalidKey, got %v", err)
+	}
+
+	g.FlushLocalCache()
+	for i, key := range keys {
+		if err := datastore.Get(c, key, &HasId{}); err != datastore.ErrNoSuchEntity {
+			t.Errorf("Expected ErrNoSuchEntity from the datastore, got %v", err)
+		}
+		if err := g.Get(items[i]); err != datastore.ErrNoSuchEntity {
+			t.Errorf("Expected ErrNoSuchEntity, got %v", err)
+		}
+	}
+}
+
+type LargeItem struct {
+	Id   int64 `datastore:"-" goon:"id"`
+	Data []byte
+}
+
+func TestCompressThreshold(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+	g.CompressThreshold = 1 << 10
+	defer func(timeout time.Duration) { MemcachePutTimeoutLarge = timeout }(MemcachePutTimeoutLarge)
+	MemcachePutTimeoutLarge = time.Second
+
+	data := bytes.Repeat([]byte("compressible "), 900<<10/13)
+	if _, err := g.Put(&LargeItem{Id: 1, Data: data}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	// Fill memcache from the datastore
+	g.FlushLocalCache()
+	if err := g.Get(&LargeItem{Id: 1}); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	item, err := memcache.Get(c, memkey(g.Key(&LargeItem{Id: 1})))
+	if err != nil {
+		t.Fatalf("Unexpected error on memcache.Get - %v", err)
+	}
+	if item.Value[0] != serializationStateCompressed || len(item.Value) > len(data)/10 {
+		t.Errorf("Expected a compressed memcache value, got %v bytes with header %v", len(item.Value), item.Value[0])
+	}
+
+	// Read it back from memcache, even without compression enabled
+	g = FromContext(c)
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+	li := &LargeItem{Id: 1}
+	if err := g.Get(li); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	if n := rec.count("datastore_v3.Get"); n != 0 {
+		t.Errorf("Expected the Get to be served by memcache, got %v datastore Gets", n)
+	}
+	if !bytes.Equal(li.Data, data) {
+		t.Errorf("Expected %v bytes of data, got %v", len(data), len(li.Data))
+	}
+
+	// Entities over memcache's size limit fit after compression
+	g.CompressThreshold = 1 << 10
+	b, err := g.serialize(&LargeItem{Data: bytes.Repeat([]byte{'x'}, 2<<20)})
+	if err != nil {
+		t.Fatalf("Unexpected error on serialize - %v", err)
+	} else if len(b) > 1<<20 {
+		t.Errorf("Expected the compressed entity to fit in memcache, got %v bytes", len(b))
+	}
+	// Small ones aren't compressed
+	if b, err := g.serialize(&LargeItem{Data: []byte("small")}); err != nil {
+		t.Fatalf("Unexpected error on serialize - %v", err)
+	} else if b[0] == serializationStateCompressed {
+		t.Errorf("Expected a small entity not to be compressed")
+	}
+}
+
+func TestTransactionNetEffect(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	if _, err := g.PutMulti([]*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	key1, key2 := g.Key(&HasId{Id: 1}), g.Key(&HasId{Id: 2})
+
+	// Put then Delete leaves nothing, Delete then Put leaves the new entity
+	if err := g.RunInTransaction(func(tg *Goon) error {
+		if _, err := tg.Put(&HasId{Id: 1, Name: "uno"}); err != nil {
+			return err
+		}
+		if err := tg.Delete(key1); err != nil {
+			return err
+		}
+		if err := tg.Delete(key2); err != nil {
+			return err
+		}
+		_, err := tg.Put(&HasId{Id: 2, Name: "dos"})
+		return err
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		t.Fatalf("Unexpected error on RunInTransaction - %v", err)
+	}
+
+	if _, ok := g.cache[memkey(key1)]; ok {
+		t.Errorf("Expected the put then deleted entity not to be cached")
+	}
+	if cached, ok := g.cache[memkey(key2)].(*HasId); !ok || cached.Name != "dos" {
+		t.Errorf("Expected dos in the local cache, got %v", g.cache[memkey(key2)])
+	}
+	if err := g.Get(&HasId{Id: 1}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Expected ErrNoSuchEntity, got %v", err)
+	}
+	g.FlushLocalCache()
+	hid := &HasId{Id: 2}
+	if err := g.Get(hid); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	} else if hid.Name != "dos" {
+		t.Errorf("Expected dos, got %v", hid.Name)
+	}
+}
+
+func TestTransactionReadYourWrites(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+
+	if _, err := g.PutMulti([]*HasId{{Id: 2, Name: "two"}, {Id: 3, Name: "three"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+
+	rec.reset()
+	if err := g.RunInTransaction(func(tg *Goon) error {
+		if _, err := tg.Put(&HasId{Id: 1, Name: "one"}); err != nil {
+			return err
+		}
+		if err := tg.Delete(tg.Key(&HasId{Id: 2})); err != nil {
+			return err
+		}
+		hid := &HasId{Id: 1}
+		if err := tg.Get(hid); err != nil {
+			return err
+		} else if hid.Name != "one" {
+			t.Errorf("Expected one, got %v", hid.Name)
+		}
+		if err := tg.Get(&HasId{Id: 2}); err != datastore.ErrNoSuchEntity {
+			t.Errorf("Expected ErrNoSuchEntity, got %v", err)
+		}
+		if n := rec.count("datastore_v3.Get"); n != 0 {
+			t.Errorf("Expected no datastore Gets, got %v", n)
+		}
+
+		// Keys that weren't written in the transaction still come from the datastore
+		hids := []*HasId{{Id: 1}, {Id: 3}}
+		if err := tg.GetMulti(hids); err != nil {
+			return err
+		} else if hids[0].Name != "one" || hids[1].Name != "three" {
+			t.Errorf("Expected one and three, got %v and %v", hids[0].Name, hids[1].Name)
+		}
+		if n := rec.count("datastore_v3.Get"); n != 1 {
+			t.Errorf("Expected 1 datastore Get, got %v", n)
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		t.Fatalf("Unexpected error on RunInTransaction - %v", err)
+	}
+}
+
+func TestGetKeys(t *testing.T) {
+	c, closer := newConsistentContext(t)
+	defer closer()
+	g := FromContext(c)
+
+	items := []*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}, {Id: 3, Name: "three"}}
+	if _, err := g.PutMulti(items); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+	memcache.Flush(c)
+
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+	keys, err := g.GetKeys(datastore.NewQuery("HasId").Order("__key__").Limit(2))
+	if err != nil {
+		t.Fatalf("Unexpected error on GetKeys - %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 keys, got %v", len(keys))
+	}
+	for i, key := range keys {
+		if key.IntID() != items[i].Id {
+			t.Errorf("Expected id %v, got %v", items[i].Id, key.IntID())
+		}
+	}
+	if n := rec.count("memcache.Set"); n != 0 {
+		t.Errorf("Expected no memcache Sets, got %v", n)
+	}
+	if len(g.cache) != 0 {
+		t.Errorf("Expected nothing to be cached locally, got %v entries", len(g.cache))
+	}
+}
+
+func TestGetAllFromCursor(t *testing.T) {
+	c, closer := newConsistentContext(t)
+	defer closer()
+	g := FromContext(c)
+
+	items := make([]*HasId, 30)
+	for i := range items {
+		items[i] = &HasId{Id: int64(i + 1), Name: fmt.Sprint(i + 1)}
+	}
+	if _, err := g.PutMulti(items); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+
+	q := datastore.NewQuery("HasId").Order("__key__").Limit(10)
+	var cursor datastore.Cursor
+	var all []HasId
+	for page := 0; page < 4; page++ {
+		var hids []HasId
+		keys, next, err := g.GetAllFromCursor(q, cursor, &hids)
+		if err != nil {
+			t.Fatalf("Unexpected error on GetAllFromCursor - %v", err)
+		}
+		expected := 10
+		if page == 3 {
+			expected = 0
+		}
+		if len(keys) != expected || len(hids) != expected {
+			t.Fatalf("Expected %v results on page %v, got %v keys and %v entities", expected, page, len(keys), len(hids))
+		}
+		for i, hid := range hids {
+			if hid.Id != keys[i].IntID() {
+				t.Errorf("Expected id %v, got %v", keys[i].IntID(), hid.Id)
+			}
+		}
+		all = append(all, hids...)
+		cursor = next
+	}
+	for i, hid := range all {
+		if hid.Id != items[i].Id || hid.Name != items[i].Name {
+			t.Errorf("Expected %+v, got %+v", *items[i], hid)
+		}
+	}
+	// The results were cached
+	if cached, ok := g.cache[memkey(g.Key(items[0]))]; !ok {
+		t.Errorf("Expected the results to be cached locally")
+	} else if cached.(*HasId).Name != "1" {
+		t.Errorf("Expected 1, got %v", cached.(*HasId).Name)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+	g.DisableMemcache = true
+
+	tg, cancel := g.WithTimeout(-time.Second) // already past its deadline
+	defer cancel()
+	if !tg.DisableMemcache {
+		t.Errorf("Expected the settings to be copied")
+	}
+	start := time.Now()
+	if _, err := tg.Put(&HasId{Id: 1}); err == nil {
+		t.Errorf("Expected an error on Put past the deadline")
+	}
+	if err := tg.Get(&HasId{Id: 2}); err == nil {
+		t.Errorf("Expected an error on Get past the deadline")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the RPCs to fail promptly, took %v", elapsed)
+	}
+
+	// The original Goon isn't affected
+	if _, err := g.Put(&HasId{Id: 1}); err != nil {
+		t.Errorf("Unexpected error on Put - %v", err)
+	}
+
+	// The local cache is shared, so the original Goon sees the changes
+	g.SetLocalCacheLimit(10)
+	tg, cancel = g.WithTimeout(time.Minute)
+	defer cancel()
+	if tg.cacheLimit != 10 {
+		t.Errorf("Expected the local cache limit to be copied, got %v", tg.cacheLimit)
+	}
+	if _, err := tg.Put(&HasId{Id: 1, Name: "one"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	hid := &HasId{Id: 1}
+	if err := g.Get(hid); err != nil {
+		t.Errorf("Unexpected error on Get - %v", err)
+	} else if hid.Name != "one" {
+		t.Errorf("Expected one, got %v", hid.Name)
+	}
+
+	// Within a transaction, the returned Goon is part of it
+	if err := g.RunInTransaction(func(tg *Goon) error {
+		ttg, cancel := tg.WithTimeout(time.Minute)
+		defer cancel()
+		if _, err := ttg.Put(&HasId{Id: 5, Name: "five"}); err != nil {
+			return err
+		}
+		if g.InLocalCache(&HasId{Id: 5}) {
+			t.Errorf("Expected the entity to be cached only after the commit")
+		}
+		return nil
+	}, nil); err != nil {
+		t.Fatalf("Unexpected error on RunInTransaction - %v", err)
+	}
+	if !g.InLocalCache(&HasId{Id: 5}) {
+		t.Errorf("Expected the entity to be cached after the commit")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	var lock sync.Mutex
+	var calls []string
+	record := func(hook string) func(*datastore.Key, interface{}) {
+		return func(key *datastore.Key, src interface{}) {
+			lock.Lock()
+			defer lock.Unlock()
+			calls = append(calls, fmt.Sprintf("%v %v %v", hook, key.IntID(), src.(*HasId).Name))
+		}
+	}
+	g.BeforePut = func(key *datastore.Key, src interface{}) {
+		record("BeforePut")(key, src)
+		src.(*HasId).Name += "!" // hooks can modify the entity before it is saved
+	}
+	g.AfterPut = record("AfterPut")
+	g.AfterGet = func(key *datastore.Key, dst interface{}) {
+		record("AfterGet")(key, dst)
+		dst.(*HasId).Name += "?" // and after it is loaded, before it is cached
+	}
+
+	items := []HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}}
+	if _, err := g.PutMulti(items); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+	hid := &HasId{Id: 2}
+	if err := g.Get(hid); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	} else if hid.Name != "two!?" {
+		t.Errorf("Expected two!?, got %v", hid.Name)
+	}
+	// Served from the local cache, so AfterGet isn't called again
+	hid = &HasId{Id: 2}
+	if err := g.Get(hid); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	} else if hid.Name != "two!?" {
+		t.Errorf("Expected two!?, got %v", hid.Name)
+	}
+
+	expected := []string{
+		"BeforePut 1 one",
+		"BeforePut 2 two",
+		"AfterPut 1 one!",
+		"AfterPut 2 two!",
+		"AfterGet 2 two!",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected calls %v, got %v", expected, calls)
+	}
+
+	// In a transaction, AfterPut waits for the commit
+	calls = nil
+	if err := g.RunInTransaction(func(tg *Goon) error {
+		if _, err := tg.Put(&HasId{Id: 3, Name: "three"}); err != nil {
+			return err
+		}
+		if len(calls) != 1 {
+			t.Errorf("Expected only BeforePut before the commit, got %v", calls)
+		}
+		return nil
+	}, nil); err != nil {
+		t.Fatalf("Unexpected error on RunInTransaction - %v", err)
+	}
+	errAbort := errors.New("abort")
+	if err := g.RunInTransaction(func(tg *Goon) error {
+		if _, err := tg.Put(&HasId{Id: 4, Name: "four"}); err != nil {
+			return err
+		}
+		return errAbort
+	}, nil); err != errAbort {
+		t.Fatalf("Expected the transaction to fail with %v, got %v", errAbort, err)
+	}
+	expected = []string{
+		"BeforePut 3 three",
+		"AfterPut 3 three!",
+		"BeforePut 4 four",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected calls %v, got %v", expected, calls)
+	}
+}
+
+func TestNewKey(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	intKey, err := g.Put(&HasId{Id: 7})
+	if err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if key := g.NewKey(&HasId{}, "", 7, nil); !key.Equal(intKey) {
+		t.Errorf("Expected %v, got %v", intKey, key)
+	}
+
+	stringKey, err := g.Put(&HasString{Id: "seven"})
+	if err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if key := g.NewKey(HasString{}, "seven", 0, nil); !key.Equal(stringKey) {
+		t.Errorf("Expected %v, got %v", stringKey, key)
+	}
+
+	parent := datastore.NewKey(c, "Parent", "p", 0, nil)
+	childKey, err := g.Put(&HasParent{Id: 7, P: parent})
+	if err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if key := g.NewKey(&HasParent{}, "", 7, parent); !key.Equal(childKey) {
+		t.Errorf("Expected %v, got %v", childKey, key)
+	}
+
+	// Not a struct, so there is no kind to use
+	if key := g.NewKey(7, "", 7, nil); key != nil {
+		t.Errorf("Expected a nil key, got %v", key)
+	}
+}
+
+type PolyItem struct {
+	Id    int64 `datastore:"-" goon:"id"`
+	Name  string
+	Extra interface{} `datastore:"-"`
+}
+
+type polyValue struct {
+	N int
+}
+
+type polyOther struct {
+	S string
+}
+
+type polyRenamed struct{ N int }
+
+type polyClash struct{ N int }
+
+type polyClashOther struct{ S string }
+
+func TestRegisterGobType(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+	g.Codec = &memcache.Gob
+
+	// The concrete type of Extra is registered when it is encoded
+	item := &PolyItem{Id: 1, Name: "one", Extra: polyValue{N: 5}}
+	if err := g.putMemcache([]interface{}{item}, []byte{1}); err != nil {
+		t.Fatalf("Unexpected error on putMemcache - %v", err)
+	}
+	g = FromContext(c)
+	g.Codec = &memcache.Gob
+	got := &PolyItem{Id: 1}
+	if ok, err := g.CacheGet(got); err != nil || !ok {
+		t.Fatalf("Expected a memcache hit, got %v, %v", ok, err)
+	}
+	if got.Name != "one" || got.Extra != (polyValue{N: 5}) {
+		t.Errorf("Expected %+v, got %+v", *item, *got)
+	}
+
+	// Explicitly registered types can be decoded without being encoded first
+	RegisterGobType(polyOther{})
+	RegisterGobType(polyOther{}) // registering twice is harmless
+	b, err := memcache.Gob.Marshal(&PolyItem{Extra: polyOther{S: "other"}})
+	if err != nil {
+		t.Fatalf("Unexpected error on Marshal - %v", err)
+	}
+	got = &PolyItem{}
+	if err := memcache.Gob.Unmarshal(b, got); err != nil {
+		t.Fatalf("Unexpected error on Unmarshal - %v", err)
+	} else if got.Extra != (polyOther{S: "other"}) {
+		t.Errorf("Expected other, got %+v", got.Extra)
+	}
+
+	// A type registered under another name is usable, but a clashing name isn't
+	gob.RegisterName("goon.renamed", polyRenamed{})
+	if err := RegisterGobType(polyRenamed{}); err != nil {
+		t.Errorf("Unexpected error on RegisterGobType - %v", err)
+	}
+	clash := reflect.TypeOf(polyClash{})
+	gob.RegisterName(clash.PkgPath()+"."+clash.Name(), polyClashOther{}) // the name gob.Register uses
+	if err := RegisterGobType(polyClash{}); err == nil {
+		t.Errorf("Expected an error on RegisterGobType for a clashing name")
+	}
+}
+
+func TestNilMissing(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	if _, err := g.PutMulti([]*HasId{{Id: 1, Name: "one"}, {Id: 3, Name: "three"}, {Id: 5, Name: "five"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+
+	get := func() ([]*HasId, appengine.MultiError) {
+		hids := []*HasId{{Id: 1}, {Id: 2}, {Id: 3}, {Id: 4}, {Id: 5}}
+		err := g.GetMulti(&hids)
+		merr, ok := err.(appengine.MultiError)
+		if !ok {
+			t.Fatalf("Expected a MultiError, got %v", err)
+		}
+		return hids, merr
+	}
+
+	// Without NilMissing every element is kept, and the found ones are loaded
+	hids, merr := get()
+	for i, name := range []string{"one", "", "three", "", "five"} {
+		missing := name == ""
+		if NotFound(merr, i) != missing {
+			t.Errorf("Expected index %v to be missing: %v, got %v", i, missing, merr[i])
+		}
+		if hids[i] == nil || hids[i].Name != name {
+			t.Errorf("Expected %q at index %v, got %+v", name, i, hids[i])
+		}
+	}
+
+	g.NilMissing = true
+	hids, merr = get()
+	for i, name := range []string{"one", "", "three", "", "five"} {
+		if name == "" {
+			if hids[i] != nil || merr[i] != datastore.ErrNoSuchEntity {
+				t.Errorf("Expected nil at index %v, got %+v, %v", i, hids[i], merr[i])
+			}
+		} else if hids[i] == nil || hids[i].Name != name || merr[i] != nil {
+			t.Errorf("Expected %q at index %v, got %+v, %v", name, i, hids[i], merr[i])
+		}
+	}
+}
+
+func TestWarmCache(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+	if err := g.WarmCache(&HasId{Id: 1, Name: "one"}); err != nil {
+		t.Fatalf("Unexpected error on WarmCache - %v", err)
+	}
+	if err := g.WarmCache([]HasId{{Id: 2, Name: "two"}}); err != nil {
+		t.Fatalf("Unexpected error on WarmCache - %v", err)
+	}
+	if err := g.WarmCache(&HasId{}); err == nil {
+		t.Errorf("Expected an error for an incomplete key")
+	}
+
+	// Served from the local cache
+	hid := &HasId{Id: 1}
+	if err := g.Get(hid); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	} else if hid.Name != "one" {
+		t.Errorf("Expected name one, got %v", hid.Name)
+	}
+
+	// Served from memcache
+	g.FlushLocalCache()
+	hid = &HasId{Id: 2}
+	if err := g.Get(hid); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	} else if hid.Name != "two" {
+		t.Errorf("Expected name two, got %v", hid.Name)
+	}
+
+	if n := rec.count("datastore_v3.Put") + rec.count("datastore_v3.Get"); n != 0 {
+		t.Errorf("Expected no datastore RPCs, got %v", n)
+	}
+}
+
+func TestClearCache(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	hids := []*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}}
+	keys, err := g.PutMulti(hids)
+	if err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	if err := g.GetMulti([]*HasId{{Id: 1}, {Id: 2}}); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+
+	// Modify the entity behind goon's back
+	if _, err := datastore.Put(c, keys[0], &HasId{Name: "changed"}); err != nil {
+		t.Fatalf("Unexpected error on datastore.Put - %v", err)
+	}
+	if err := g.ClearCache(keys...); err != nil {
+		t.Fatalf("Unexpected error on ClearCache - %v", err)
+	}
+	// Clearing keys that aren't cached is fine
+	if err := g.ClearCache(keys...); err != nil {
+		t.Fatalf("Unexpected error on ClearCache of uncached keys - %v", err)
+	}
+
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+	hid := &HasId{Id: 1}
+	if err := g.Get(hid); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	if hid.Name != "changed" {
+		t.Errorf("Expected name changed, got %v", hid.Name)
+	}
+	if n := rec.count("datastore_v3.Get"); n != 1 {
+		t.Errorf("Expected 1 datastore Get, got %v", n)
+	}
+}
+
+type SkippedField struct {
+	Id        int64  `datastore:"-" goon:"id"`
+	Name      string `datastore:",noindex"`
+	Transient string `datastore:"-"`
+}
+
+func TestSkippedFieldCache(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	if _, err := g.Put(&SkippedField{Id: 1, Name: "one", Transient: "not stored"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+
+	// The first Get is a memcache miss, loaded from the datastore
+	g.FlushLocalCache()
+	fromDatastore := &SkippedField{Id: 1}
+	if err := g.Get(fromDatastore); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	if st := g.Stats(); st.DatastoreReads != 1 {
+		t.Fatalf("Expected a datastore read, got %+v", st)
+	}
+
+	// The second is a memcache hit
+	g.FlushLocalCache()
+	fromMemcache := &SkippedField{Id: 1}
+	if err := g.Get(fromMemcache); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	if st := g.Stats(); st.MemcacheHits != 1 {
+		t.Fatalf("Expected a memcache hit, got %+v", st)
+	}
+
+	if !reflect.DeepEqual(fromDatastore, fromMemcache) {
+		t.Errorf("Expected the memcache hit %+v to match the datastore read %+v", fromMemcache, fromDatastore)
+	}
+	if fromMemcache.Transient != "" {
+		t.Errorf("Expected the skipped field not to be cached, got %q", fromMemcache.Transient)
+	}
+}
+
+func TestDeleteQuery(t *testing.T) {
+	c, closer := newConsistentContext(t)
+	defer closer()
+	g := FromContext(c)
+
+	items := make([]*HasId, 30)
+	for i := range items {
+		name := "even"
+		if i%2 == 1 {
+			name = "odd"
+		}
+		items[i] = &HasId{Id: int64(i + 1), Name: name}
+	}
+	if _, err := g.PutMulti(items); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+
+	// Delete in several batches
+	g.DeleteMultiLimit = 4
+	n, err := g.DeleteQuery(datastore.NewQuery("HasId").Filter("Name =", "odd"))
+	if err != nil {
+		t.Fatalf("Unexpected error on DeleteQuery - %v", err)
+	}
+	if n != 15 {
+		t.Errorf("Expected 15 deleted entities, got %v", n)
+	}
+
+	// Both the local cache and the datastore must agree
+	for _, flush := range []bool{false, true} {
+		if flush {
+			g.FlushLocalCache()
+		}
+		hids := make([]*HasId, len(items))
+		for i := range hids {
+			hids[i] = &HasId{Id: items[i].Id}
+		}
+		err := g.GetMulti(hids)
+		for i, item := range items {
+			if deleted := item.Name == "odd"; NotFound(err, i) != deleted {
+				t.Errorf("Expected entity %v deleted: %v, got %v", item.Id, deleted, err)
+			}
+		}
+	}
+
+	if n, err := g.DeleteQuery(datastore.NewQuery("HasId").Filter("Name =", "odd")); err != nil || n != 0 {
+		t.Errorf("Expected nothing left to delete, got %v, %v", n, err)
+	}
+}
+
+func TestGetMultiSource(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	if _, err := g.PutMulti([]*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}, {Id: 3, Name: "three"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+	memcache.Flush(c)
+
+	// Cache 2 in memcache only, and 1 in the local cache too
+	if err := g.Get(&HasId{Id: 2}); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	g.FlushLocalCache()
+	if err := g.Get(&HasId{Id: 1}); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+
+	get := func() ([]*HasId, []Source) {
+		hids := []*HasId{{Id: 1}, {Id: 2}, {Id: 3}, {Id: 4}}
+		sources, err := g.GetMultiSource(hids)
+		if !NotFound(err, 3) {
+			t.Fatalf("Expected index 3 not to be found, got %v", err)
+		}
+		return hids, sources
+	}
+
+	hids, sources := get()
+	expected := []Source{SourceLocal, SourceMemcache, SourceDatastore, SourceMiss}
+	if !reflect.DeepEqual(sources, expected) {
+		t.Errorf("Expected sources %v, got %v", expected, sources)
+	}
+	for i, name := range []string{"one", "two", "three"} {
+		if hids[i].Name != name {
+			t.Errorf("Expected name %v at index %v, got %v", name, i, hids[i].Name)
+		}
+	}
+
+	// Everything found is now in the local cache
+	hids, sources = get()
+	expected = []Source{SourceLocal, SourceLocal, SourceLocal, SourceMiss}
+	if !reflect.DeepEqual(sources, expected) {
+		t.Errorf("Expected sources %v, got %v", expected, sources)
+	}
+	if hids[3] == nil {
+		t.Errorf("Expected the missing entity to be left alone without NilMissing")
+	}
+
+	// Missing entities are set to nil like GetMulti does
+	g.NilMissing = true
+	hids, _ = get()
+	if hids[3] != nil {
+		t.Errorf("Expected the missing entity to be nil, got %+v", hids[3])
+	}
+
+	// Not a slice
+	if _, err := g.GetMultiSource(&HasId{Id: 1}); err == nil {
+		t.Errorf("Expected an error for a non-slice dst")
+	}
+}
+
+func TestMemcacheDeleteBatches(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	var lock sync.Mutex
+	var batches []int
+	g.Context = appengine.WithAPICallFunc(c, func(ctx context.Context, service, method string, in, out proto.Message) error {
+		if service == "memcache" && method == "Delete" {
+			lock.Lock()
+			batches = append(batches, reflect.ValueOf(in).Elem().FieldByName("Item").Len())
+			lock.Unlock()
+		}
+		return appengine.APICall(ctx, service, method, in, out)
+	})
+	check := func(op string, n int) {
+		lock.Lock()
+		defer lock.Unlock()
+		if expected := (n-1)/memcacheDeleteMultiLimit + 1; len(batches) != expected {
+			t.Errorf("Expected %v memcache deletes on %v, got %v", expected, op, len(batches))
+		}
+		total := 0
+		for _, b := range batches {
+			if b > memcacheDeleteMultiLimit {
+				t.Errorf("Expected at most %v keys per memcache delete on %v, got %v", memcacheDeleteMultiLimit, op, b)
+			}
+			total += b
+		}
+		if total != n {
+			t.Errorf("Expected %v keys deleted from memcache on %v, got %v", n, op, total)
+		}
+		batches = nil
+	}
+
+	const n = 2500
+	hids := make([]*HasId, n)
+	for i := range hids {
+		hids[i] = &HasId{Id: int64(i + 1)}
+	}
+	keys, err := g.PutMulti(hids)
+	if err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	check("PutMulti", n)
+
+	if err := g.DeleteMulti(keys); err != nil {
+		t.Fatalf("Unexpected error on DeleteMulti - %v", err)
+	}
+	check("DeleteMulti", n)
+}
+
+type Counter struct {
+	Id    int64 `datastore:"-" goon:"id"`
+	Group string
+	N     int
+}
+
+func TestMigrate(t *testing.T) {
+	c, closer := newConsistentContext(t)
+	defer closer()
+	g := FromContext(c)
+
+	counters := make([]*Counter, 10)
+	for i := range counters {
+		group := "a"
+		if i%2 == 1 {
+			group = "b"
+		}
+		counters[i] = &Counter{Id: int64(i + 1), Group: group, N: i}
+	}
+	if _, err := g.PutMulti(counters); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	// Cache everything in memcache too, so that stale entries would be noticed
+	cached := make([]*Counter, len(counters))
+	for i, counter := range counters {
+		cached[i] = &Counter{Id: counter.Id}
+	}
+	g.FlushLocalCache()
+	if err := g.GetMulti(cached); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+
+	// Migrate in several batches
+	g.PutMultiLimit = 2
+	n, err := g.Migrate(datastore.NewQuery("Counter").Filter("Group =", "a"), func(src interface{}) error {
+		src.(*Counter).N += 100
+		return nil
+	}, func() interface{} { return &Counter{} })
+	if err != nil {
+		t.Fatalf("Unexpected error on Migrate - %v", err)
+	}
+	if n != 5 {
+		t.Errorf("Expected 5 migrated entities, got %v", n)
+	}
+
+	for _, flush := range []bool{false, true} {
+		if flush {
+			g.FlushLocalCache()
+			memcache.Flush(c)
+		}
+		for i, counter := range counters {
+			got := &Counter{Id: counter.Id}
+			if err := g.Get(got); err != nil {
+				t.Fatalf("Unexpected error on Get - %v", err)
+			}
+			expected := i
+			if counter.Group == "a" {
+				expected += 100
+			}
+			if got.N != expected {
+				t.Errorf("Expected N %v for %v, got %v", expected, counter.Id, got.N)
+			}
+		}
+	}
+
+	// A failing transform stops the migration
+	errStop := errors.New("stop")
+	if _, err := g.Migrate(datastore.NewQuery("Counter"), func(interface{}) error {
+		return errStop
+	}, func() interface{} { return &Counter{} }); err != errStop {
+		t.Errorf("Expected the transform error, got %v", err)
+	}
+}
+
+func TestInLocalCache(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	hid := &HasId{Id: 1, Name: "one"}
+	if g.InLocalCache(hid) {
+		t.Errorf("Expected the entity not to be cached before Put")
+	}
+	key, err := g.Put(hid)
+	if err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if !g.InLocalCache(&HasId{Id: 1}) {
+		t.Errorf("Expected the entity to be cached after Put")
+	}
+	if err := g.ClearCache(key); err != nil {
+		t.Fatalf("Unexpected error on ClearCache - %v", err)
+	}
+	if g.InLocalCache(hid) {
+		t.Errorf("Expected the entity not to be cached after ClearCache")
+	}
+	if err := g.Get(&HasId{Id: 1}); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	if !g.InLocalCache(hid) {
+		t.Errorf("Expected the entity to be cached after Get")
+	}
+	g.FlushLocalCache()
+	if g.InLocalCache(hid) {
+		t.Errorf("Expected the entity not to be cached after FlushLocalCache")
+	}
+	if g.InLocalCache(&HasId{}) {
+		t.Errorf("Expected an incomplete key not to be cached")
+	}
+}
+
+// Composite is identified by both its region and its name.
+type Composite struct {
+	Region string
+	Name   string
+	Value  int
+}
+
+func (c *Composite) GoonKey(g *Goon) *datastore.Key {
+	return datastore.NewKey(g.Context, "Composite", c.Region+"/"+c.Name, 0, nil)
+}
+
+func TestKeyProvider(t *testing.T) {
+	c, closer := newConsistentContext(t)
+	defer closer()
+	g := FromContext(c)
+
+	src := &Composite{Region: "eu", Name: "alpha", Value: 1}
+	key, err := g.Put(src)
+	if err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if key.Kind() != "Composite" || key.StringID() != "eu/alpha" {
+		t.Errorf("Expected key Composite eu/alpha, got %v", key)
+	}
+	if k := g.Key(&Composite{Region: "eu", Name: "alpha"}); !k.Equal(key) {
+		t.Errorf("Expected Key %v, got %v", key, k)
+	}
+	if _, err := g.Put(&Composite{Region: "us", Name: "alpha", Value: 2}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+
+	for _, flush := range []bool{false, true} {
+		if flush {
+			g.FlushLocalCache()
+			memcache.Flush(c)
+		}
+		dst := &Composite{Region: "eu", Name: "alpha"}
+		if err := g.Get(dst); err != nil {
+			t.Fatalf("Unexpected error on Get - %v", err)
+		}
+		if dst.Value != 1 {
+			t.Errorf("Expected value 1, got %v", dst.Value)
+		}
+	}
+
+	var all []*Composite
+	if _, err := g.GetAll(datastore.NewQuery("Composite").Order("Region"), &all); err != nil {
+		t.Fatalf("Unexpected error on GetAll - %v", err)
+	}
+	if len(all) != 2 || all[0].Value != 1 || all[1].Value != 2 {
+		t.Errorf("Expected both entities, got %+v", all)
+	}
+
+	// Value slices use the pointer receiver GoonKey too
+	keys, err := g.PutMulti([]Composite{{Region: "ap", Name: "beta", Value: 3}})
+	if err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	} else if keys[0].StringID() != "ap/beta" {
+		t.Errorf("Expected key ap/beta, got %v", keys[0])
+	}
+
+	// Loaders that only know the key can't fill in the fields GoonKey uses
+	m := make(map[*datastore.Key]*Composite)
+	if err := g.GetMap([]*datastore.Key{key}, &m); err == nil {
+		t.Errorf("Expected an error on GetMap, got %v", m)
+	}
+}
+
+func TestRunInTransactionXG(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	// Two root entities are two entity groups
+	if err := g.RunInTransactionXG(func(tg *Goon) error {
+		if _, err := tg.Put(&HasId{Id: 1, Name: "one"}); err != nil {
+			return err
+		}
+		_, err := tg.Put(&HasId{Id: 2, Name: "two"})
+		return err
+	}); err != nil {
+		t.Fatalf("Unexpected error on RunInTransactionXG - %v", err)
+	}
+
+	hids := []*HasId{{Id: 1}, {Id: 2}}
+	if err := g.GetMulti(hids); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+	if hids[0].Name != "one" || hids[1].Name != "two" {
+		t.Errorf("Expected both entities to be saved, got %+v, %+v", hids[0], hids[1])
+	}
+}
+
+func TestFailedPutEvictsLocalCache(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	if _, err := g.PutMulti([]*HasId{{Id: 1, Name: "old"}, {Id: 2, Name: "old"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+
+	// Fail the first of two batches
+	var lock sync.Mutex
+	failed := false
+	putErr := errors.New("datastore is down")
+	g.Context = appengine.WithAPICallFunc(c, func(ctx context.Context, service, method string, in, out proto.Message) error {
+		if service == "datastore_v3" && method == "Put" {
+			lock.Lock()
+			first := !failed
+			failed = true
+			lock.Unlock()
+			if first {
+				return putErr
+			}
+		}
+		return appengine.APICall(ctx, service, method, in, out)
+	})
+	g.PutMultiLimit = 1
+	if _, err := g.PutMulti([]*HasId{{Id: 1, Name: "new"}, {Id: 2, Name: "new"}}); err != putErr {
+		t.Fatalf("Expected %v, got %v", putErr, err)
+	}
+
+	cached := 0
+	for _, id := range []int64{1, 2} {
+		if !g.InLocalCache(&HasId{Id: id}) {
+			continue
+		}
+		cached++
+		hid := &HasId{Id: id}
+		if err := g.Get(hid); err != nil {
+			t.Fatalf("Unexpected error on Get - %v", err)
+		}
+		if hid.Name != "new" {
+			t.Errorf("Expected the cached entity %v to be the new one, got %v", id, hid.Name)
+		}
+	}
+	if cached != 1 {
+		t.Errorf("Expected only the entity that was saved to be cached, got %v cached", cached)
+	}
+}
+
+func TestGetMap(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	if _, err := g.PutMulti([]*HasId{{Id: 1, Name: "one"}, {Id: 3, Name: "three"}, {Id: 5, Name: "five"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	keys := make([]*datastore.Key, 5)
+	for i := range keys {
+		keys[i] = g.NewKey(&HasId{}, "", int64(i+1), nil)
+	}
+
+	var byKey map[*datastore.Key]*HasId
+	if err := g.GetMap(keys, &byKey); err != nil {
+		t.Fatalf("Unexpected error on GetMap - %v", err)
+	}
+	if len(byKey) != 3 {
+		t.Errorf("Expected 3 entries, got %v", len(byKey))
+	}
+	for i, name := range []string{"one", "", "three", "", "five"} {
+		hid, ok := byKey[keys[i]]
+		if ok != (name != "") {
+			t.Errorf("Expected key %v present: %v, got %v", keys[i], name != "", ok)
+		} else if ok && (hid.Name != name || hid.Id != keys[i].IntID()) {
+			t.Errorf("Expected %v for key %v, got %+v", name, keys[i], hid)
+		}
+	}
+
+	byString := map[string]*HasId{}
+	if err := g.GetMap(keys, &byString); err != nil {
+		t.Fatalf("Unexpected error on GetMap - %v", err)
+	}
+	if len(byString) != 3 {
+		t.Errorf("Expected 3 entries, got %v", len(byString))
+	}
+	if hid := byString[keys[2].Encode()]; hid == nil || hid.Name != "three" {
+		t.Errorf("Expected three for the encoded key, got %+v", hid)
+	}
+
+	if err := g.GetMap(keys, map[string]*HasId{}); err == nil {
+		t.Errorf("Expected an error for a map that isn't a pointer")
+	}
+	if err := g.GetMap(keys, &map[int]*HasId{}); err == nil {
+		t.Errorf("Expected an error for int map keys")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	if _, err := g.Put(&HasId{Id: 1, Name: "one"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+
+	var logged []string
+	g.infof = func(c context.Context, format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+	g.DryRun = true
+	keys, err := g.PutMulti([]*HasId{{Id: 1, Name: "changed"}, {Id: 2, Name: "two"}})
+	if err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	if err := g.DeleteMulti(keys); err != nil {
+		t.Fatalf("Unexpected error on DeleteMulti - %v", err)
+	}
+	for _, call := range []string{"datastore_v3.Put", "datastore_v3.Delete", "memcache.Set", "memcache.Delete"} {
+		if n := rec.count(call); n != 0 {
+			t.Errorf("Expected no %v calls, got %v", call, n)
+		}
+	}
+	if len(logged) != 2 {
+		t.Fatalf("Expected 2 log messages, got %v", logged)
+	}
+	for _, msg := range logged {
+		if !strings.Contains(msg, "2 entities") || !strings.Contains(msg, keys[0].String()) || !strings.Contains(msg, keys[1].String()) {
+			t.Errorf("Expected the message to list both keys, got %q", msg)
+		}
+	}
+
+	// Reads work as usual, and see the unchanged entities
+	g.FlushLocalCache()
+	hids := []*HasId{{Id: 1}, {Id: 2}}
+	if err := g.GetMulti(hids); !NotFound(err, 1) {
+		t.Fatalf("Expected only the second entity to be missing, got %v", err)
+	}
+	if hids[0].Name != "one" {
+		t.Errorf("Expected the entity to be unchanged, got %v", hids[0].Name)
+	}
+}
+
+func TestCachePrefix(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	g.CachePrefix = "v1:"
+	key, err := g.Put(&HasId{Id: 1, Name: "one"})
+	if err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	g.FlushLocalCache()
+	if err := g.Get(&HasId{Id: 1}); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	if _, err := memcache.Get(c, "v1:"+memkey(key)); err != nil {
+		t.Errorf("Expected the entity in memcache under the prefix - %v", err)
+	}
+	if _, err := memcache.Get(c, memkey(key)); err != memcache.ErrCacheMiss {
+		t.Errorf("Expected no entity in memcache without the prefix, got %v", err)
+	}
+
+	source := func() Source {
+		g.FlushLocalCache()
+		sources, err := g.GetMultiSource([]*HasId{{Id: 1}})
+		if err != nil {
+			t.Fatalf("Unexpected error on GetMultiSource - %v", err)
+		}
+		return sources[0]
+	}
+	g.CachePrefix = "v2:"
+	if s := source(); s != SourceDatastore {
+		t.Errorf("Expected the v1 entry to be ignored under v2, got %v", s)
+	}
+	if s := source(); s != SourceMemcache {
+		t.Errorf("Expected a v2 entry to be read under v2, got %v", s)
+	}
+
+	// Deletes evict the entry under the current prefix
+	if err := g.Delete(key); err != nil {
+		t.Fatalf("Unexpected error on Delete - %v", err)
+	}
+	if _, err := memcache.Get(c, "v2:"+memkey(key)); err != memcache.ErrCacheMiss {
+		t.Errorf("Expected the v2 entry to be deleted, got %v", err)
+	}
+}
+
+// mapCacheLayer is a CacheLayer backed by a map. Its clock can be set, to
+// test expiration.
+type mapCacheLayer struct {
+	sync.Mutex
+	items   map[string][]byte
+	expires map[string]time.Time
+	now     time.Time
+}
+
+func (l *mapCacheLayer) GetFromCache(keys []string) map[string][]byte {
+	l.Lock()
+	defer l.Unlock()
+	found := make(map[string][]byte)
+	for _, k := range keys {
+		if exp, ok := l.expires[k]; ok && !l.now.Before(exp) {
+			delete(l.items, k)
+			delete(l.expires, k)
+		}
+		if b, ok := l.items[k]; ok {
+			found[k] = b
+		}
+	}
+	return found
+}
+
+func (l *mapCacheLayer) SetToCache(items map[string][]byte, expiration time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	if l.expires == nil {
+		l.expires = make(map[string]time.Time)
+	}
+	for k, b := range items {
+		delete(l.expires, k)
+		if b == nil {
+			delete(l.items, k)
+			continue
+		}
+		l.items[k] = b
+		if expiration > 0 {
+			l.expires[k] = l.now.Add(expiration)
+		}
+	}
+}
+
+func TestCacheLayer(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	layer := &mapCacheLayer{items: make(map[string][]byte)}
+	g := FromContext(c)
+	g.CacheLayer = layer
+
+	if _, err := g.PutMulti([]*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	// Loading from the datastore fills the layer
+	g.FlushLocalCache()
+	if err := g.GetMulti([]*HasId{{Id: 1}, {Id: 2}, {Id: 3}}); !NotFound(err, 2) {
+		t.Fatalf("Expected only the third entity to be missing, got %v", err)
+	}
+	if len(layer.items) != 3 {
+		t.Errorf("Expected 3 items in the layer, got %v", len(layer.items))
+	}
+
+	// Another request is served from the layer without memcache
+	rec := &rpcRecorder{}
+	g = FromContext(rec.wrap(c))
+	g.CacheLayer = layer
+	hids := []*HasId{{Id: 1}, {Id: 2}, {Id: 3}}
+	sources, err := g.GetMultiSource(hids)
+	if !NotFound(err, 2) {
+		t.Fatalf("Expected only the third entity to be missing, got %v", err)
+	}
+	if expected := []Source{SourceCacheLayer, SourceCacheLayer, SourceMiss}; !reflect.DeepEqual(sources, expected) {
+		t.Errorf("Expected sources %v, got %v", expected, sources)
+	}
+	if hids[0].Name != "one" || hids[1].Name != "two" {
+		t.Errorf("Expected the cached entities, got %+v, %+v", hids[0], hids[1])
+	}
+	if n := rec.count("memcache.Get") + rec.count("datastore_v3.Get"); n != 0 {
+		t.Errorf("Expected no memcache or datastore Gets, got %v", n)
+	}
+	if st := g.Stats(); st.CacheLayerHits != 3 {
+		t.Errorf("Expected 3 layer hits, got %+v", st)
+	}
+
+	// CacheGet and ExistsMulti use the layer too
+	rec.reset()
+	g = FromContext(rec.wrap(c))
+	g.CacheLayer = layer
+	hid := &HasId{Id: 2}
+	if ok, err := g.CacheGet(hid); err != nil || !ok {
+		t.Errorf("Expected a layer hit on CacheGet, got %v, %v", ok, err)
+	} else if hid.Name != "two" {
+		t.Errorf("Expected two, got %v", hid.Name)
+	}
+	g.FlushLocalCache()
+	exists, err := g.ExistsMulti([]*HasId{{Id: 1}, {Id: 2}, {Id: 3}})
+	if err != nil {
+		t.Fatalf("Unexpected error on ExistsMulti - %v", err)
+	} else if expected := []bool{true, true, false}; !reflect.DeepEqual(exists, expected) {
+		t.Errorf("Expected %v, got %v", expected, exists)
+	}
+	if n := rec.count("memcache.Get") + rec.count("datastore_v3.Get"); n != 0 {
+		t.Errorf("Expected no memcache or datastore Gets, got %v", n)
+	}
+	if st := g.Stats(); st.CacheLayerHits != 1 {
+		t.Errorf("Expected 1 layer hit, got %+v", st)
+	}
+
+	// Writes evict the layer
+	if _, err := g.Put(&HasId{Id: 1, Name: "changed"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if _, ok := layer.items[memkey(g.Key(&HasId{Id: 1}))]; ok {
+		t.Errorf("Expected the put entity to be evicted from the layer")
+	}
+	g.FlushLocalCache()
+	hid = &HasId{Id: 1}
+	if err := g.Get(hid); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	} else if hid.Name != "changed" {
+		t.Errorf("Expected the changed entity, got %v", hid.Name)
+	}
+}
+
+func TestRefreshLocal(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	hid := &HasId{Id: 1, Name: "one"}
+	if _, err := g.Put(hid); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+
+	// The local cache holds a copy, so changes aren't seen yet
+	hid.Name = "changed"
+	got := &HasId{Id: 1}
+	if err := g.Get(got); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	if got.Name != "one" {
+		t.Errorf("Expected the cached copy to be unchanged, got %v", got.Name)
+	}
+	// Neither are changes to a loaded entity
+	got.Name = "also changed"
+	again := &HasId{Id: 1}
+	if err := g.Get(again); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	if again.Name != "one" {
+		t.Errorf("Expected the cached copy to be unchanged, got %v", again.Name)
+	}
+
+	g.RefreshLocal(hid)
+	hid.Name = "after refresh"
+	got = &HasId{Id: 1}
+	if err := g.Get(got); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	if got.Name != "changed" {
+		t.Errorf("Expected the refreshed entity, got %v", got.Name)
+	}
+
+	// Only the local cache was refreshed
+	g.FlushLocalCache()
+	got = &HasId{Id: 1}
+	if err := g.Get(got); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	if got.Name != "one" {
+		t.Errorf("Expected the saved entity, got %v", got.Name)
+	}
+}
+
+type Expiring struct {
+	Id        int64     `datastore:"-" goon:"id"`
+	ExpiresAt time.Time `goon:"expires"`
+}
+
+func TestExpiresField(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	srcs := []interface{}{
+		&Expiring{Id: 1, ExpiresAt: time.Now().Add(2 * time.Second)},
+		&Expiring{Id: 2, ExpiresAt: time.Now().Add(-time.Second)},
+		&Expiring{Id: 3},
+	}
+	items, expired, _, err := g.memcacheItems(srcs, []byte{1, 1, 1})
+	if err != nil {
+		t.Fatalf("Unexpected error on memcacheItems - %v", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("Expected the expired entity to be left out, got %v items", len(items))
+	}
+	if len(expired) != 1 || expired[0] != memkey(g.Key(srcs[1])) {
+		t.Errorf("Expected the expired entity's key, got %v", expired)
+	}
+	if exp := items[0].Expiration; exp <= time.Second || exp > 2*time.Second {
+		t.Errorf("Expected an expiration of about 2s, got %v", exp)
+	}
+	if items[1].Key != memkey(g.Key(srcs[2])) || items[1].Expiration != 0 {
+		t.Errorf("Expected the entity without expiry not to expire, got %v", items[1].Expiration)
+	}
+
+	// An earlier MemcacheExpiration wins
+	g.MemcacheExpiration = time.Second
+	items, _, _, err = g.memcacheItems(srcs[:1], []byte{1})
+	if err != nil {
+		t.Fatalf("Unexpected error on memcacheItems - %v", err)
+	}
+	if items[0].Expiration != time.Second {
+		t.Errorf("Expected an expiration of 1s, got %v", items[0].Expiration)
+	}
+	g.MemcacheExpiration = 0
+
+	// Only the unexpired entity ends up in memcache
+	if _, err := g.PutMulti(srcs); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+	if err := g.GetMulti([]*Expiring{{Id: 1}, {Id: 2}}); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+	if _, err := memcache.Get(c, memkey(g.Key(srcs[0]))); err != nil {
+		t.Errorf("Expected the unexpired entity in memcache - %v", err)
+	}
+	if _, err := memcache.Get(c, memkey(g.Key(srcs[1]))); err != memcache.ErrCacheMiss {
+		t.Errorf("Expected the expired entity not to be in memcache, got %v", err)
+	}
+}
+
+func TestGetByKeys(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	keys, err := g.PutMulti([]interface{}{&HasId{Id: 1, Name: "one"}, &HasString{Id: "a", Name: "A"}})
+	if err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	keys = append(keys, g.NewKey(&HasId{}, "", 2, nil))
+	g.FlushLocalCache()
+
+	newFunc := func(key *datastore.Key) interface{} {
+		switch key.Kind() {
+		case "HasId":
+			return &HasId{}
+		case "HasString":
+			return &HasString{}
+		}
+		t.Fatalf("Unexpected kind %v", key.Kind())
+		return nil
+	}
+	dst, err := g.GetByKeys(keys, newFunc)
+	if !NotFound(err, 2) || NotFound(err, 0) || NotFound(err, 1) {
+		t.Fatalf("Expected only the third entity to be missing, got %v", err)
+	}
+	if hid := dst[0].(*HasId); hid.Id != 1 || hid.Name != "one" {
+		t.Errorf("Expected HasId one, got %+v", hid)
+	}
+	if hs := dst[1].(*HasString); hs.Id != "a" || hs.Name != "A" {
+		t.Errorf("Expected HasString A, got %+v", hs)
+	}
+	if hid := dst[2].(*HasId); hid.Id != 2 {
+		t.Errorf("Expected the missing entity to have its key set, got %+v", hid)
+	}
+}
+
+type Timestamped struct {
+	Id        int64 `datastore:"-" goon:"id"`
+	Name      string
+	CreatedAt time.Time `goon:"created"`
+	UpdatedAt time.Time `goon:"updated"`
+}
+
+func TestTimestamps(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	before := time.Now().Truncate(time.Microsecond)
+	ts := &Timestamped{Name: "first"}
+	if _, err := g.Put(ts); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if ts.CreatedAt.Before(before) || !ts.UpdatedAt.Equal(ts.CreatedAt) {
+		t.Fatalf("Expected both timestamps to be set to now, got %v and %v", ts.CreatedAt, ts.UpdatedAt)
+	}
+	created := ts.CreatedAt
+
+	time.Sleep(time.Millisecond)
+	ts.Name = "second"
+	if _, err := g.Put(ts); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if !ts.CreatedAt.Equal(created) {
+		t.Errorf("Expected created to stay %v, got %v", created, ts.CreatedAt)
+	}
+	if !ts.UpdatedAt.After(created) {
+		t.Errorf("Expected updated to be after %v, got %v", created, ts.UpdatedAt)
+	}
+
+	// The timestamps are stored, and cached as stored
+	for _, flush := range []bool{false, true} {
+		if flush {
+			g.FlushLocalCache()
+			memcache.Flush(c)
+		}
+		got := &Timestamped{Id: ts.Id}
+		if err := g.Get(got); err != nil {
+			t.Fatalf("Unexpected error on Get - %v", err)
+		}
+		if !got.CreatedAt.Equal(ts.CreatedAt) || !got.UpdatedAt.Equal(ts.UpdatedAt) {
+			t.Errorf("Expected timestamps %v and %v, got %v and %v", ts.CreatedAt, ts.UpdatedAt, got.CreatedAt, got.UpdatedAt)
+		}
+	}
+
+	// A new entity with a complete key gets a created timestamp too
+	ts = &Timestamped{Id: 100}
+	if _, err := g.Put(ts); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if ts.CreatedAt.IsZero() || !ts.UpdatedAt.Equal(ts.CreatedAt) {
+		t.Errorf("Expected both timestamps to be set, got %v and %v", ts.CreatedAt, ts.UpdatedAt)
+	}
+}
+
+// TestConcurrentRequestGets checks that requests that concurrently load the
+// same entity from the datastore, and so concurrently store it in memcache,
+// don't fail. Memcache is written with SetMulti, so the last write wins.
+func TestConcurrentRequestGets(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+
+	if _, err := FromContext(c).Put(&HasId{Id: 1, Name: "one"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+
+	for round := 0; round < 5; round++ {
+		memcache.Flush(c)
+		var wg sync.WaitGroup
+		for x := 0; x < 10; x++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				g := FromContext(c) // a separate request
+				g.SetTesting(true)
+				var handled []error
+				g.ErrorHandler = func(c context.Context, err error) {
+					handled = append(handled, err)
+				}
+				hid := &HasId{Id: 1}
+				if err := g.Get(hid); err != nil {
+					t.Errorf("Unexpected error on Get - %v", err)
+				} else if hid.Name != "one" {
+					t.Errorf("Expected one, got %v", hid.Name)
+				}
+				if len(handled) > 0 {
+					t.Errorf("Expected no errors to be handled, got %v", handled)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+type Article struct {
+	Id     int64 `datastore:"-" goon:"id"`
+	Title  string
+	Author string
+	Body   string `datastore:",noindex"`
+}
+
+type ArticleSummary struct {
+	Id     int64 `datastore:"-" goon:"id"`
+	Title  string
+	Author string
+}
+
+func TestGetProjection(t *testing.T) {
+	c, closer := newConsistentContext(t)
+	defer closer()
+	g := FromContext(c)
+
+	articles := []*Article{
+		{Id: 1, Title: "First", Author: "ann", Body: "long text"},
+		{Id: 2, Title: "Second", Author: "bob", Body: "longer text"},
+	}
+	if _, err := g.PutMulti(articles); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+	memcache.Flush(c)
+
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+	var summaries []ArticleSummary
+	keys, err := g.GetProjection(datastore.NewQuery("Article").Project("Title", "Author").Order("Title"), &summaries)
+	if err != nil {
+		t.Fatalf("Unexpected error on GetProjection - %v", err)
+	}
+	if len(keys) != 2 || len(summaries) != 2 {
+		t.Fatalf("Expected 2 results, got %v keys and %v summaries", len(keys), len(summaries))
+	}
+	for i, article := range articles {
+		if s := summaries[i]; s.Id != article.Id || s.Title != article.Title || s.Author != article.Author {
+			t.Errorf("Expected the projection of %+v, got %+v", article, s)
+		}
+	}
+
+	if n := rec.count("memcache.Set"); n != 0 {
+		t.Errorf("Expected no memcache Sets, got %v", n)
+	}
+	if len(g.cache) != 0 {
+		t.Errorf("Expected nothing to be cached locally, got %v entries", len(g.cache))
+	}
+
+	// A full Get still loads the whole entity
+	article := &Article{Id: 1}
+	if err := g.Get(article); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	if article.Body != "long text" {
+		t.Errorf("Expected the full entity, got %+v", article)
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	c, closer := newConsistentContext(t)
+	defer closer()
+	g := FromContext(c)
+
+	counters := make([]*Counter, 6)
+	for i := range counters {
+		counters[i] = &Counter{Id: int64(i + 1)}
+	}
+	keys, err := g.PutMulti(counters)
+	if err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+
+	// Batch operations stop before issuing any datastore RPCs
+	rec := &rpcRecorder{}
+	cc, cancel := context.WithCancel(rec.wrap(c))
+	cancel()
+	g.Context = cc
+	g.ErrorHandler = func(context.Context, error) {}
+	if _, err := g.PutMulti(counters); err != context.Canceled {
+		t.Errorf("Expected PutMulti to fail with %v, got %v", context.Canceled, err)
+	}
+	if err := g.GetMulti([]*Counter{{Id: 1}, {Id: 2}}); err != context.Canceled {
+		t.Errorf("Expected GetMulti to fail with %v, got %v", context.Canceled, err)
+	}
+	if err := g.DeleteMulti(keys); err != context.Canceled {
+		t.Errorf("Expected DeleteMulti to fail with %v, got %v", context.Canceled, err)
+	}
+	if _, err := g.ExistsMulti([]*Counter{{Id: 1}, {Id: 2}}); err != context.Canceled {
+		t.Errorf("Expected ExistsMulti to fail with %v, got %v", context.Canceled, err)
+	}
+	for _, call := range []string{"datastore_v3.Put", "datastore_v3.Get", "datastore_v3.Delete"} {
+		if n := rec.count(call); n != 0 {
+			t.Errorf("Expected no %v calls, got %v", call, n)
+		}
+	}
+
+	// Migrate stops after the current batch once the context is cancelled
+	cc, cancel = context.WithCancel(c)
+	defer cancel()
+	g.Context = cc
+	g.PutMultiLimit = 2
+	transformed := 0
+	n, err := g.Migrate(datastore.NewQuery("Counter").Order("__key__"), func(src interface{}) error {
+		if transformed++; transformed == 3 {
+			cancel()
+		}
+		src.(*Counter).N = 1
+		return nil
+	}, func() interface{} { return &Counter{} })
+	if err != context.Canceled {
+		t.Errorf("Expected Migrate to fail with %v, got %v", context.Canceled, err)
+	}
+	if n != 2 || transformed != 3 {
+		t.Errorf("Expected 2 entities to be migrated and 3 transformed, got %v and %v", n, transformed)
+	}
+}
+
+func TestTransactionInvalidatesMemcache(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	g := FromContext(c)
+
+	keys, err := g.PutMulti([]*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}})
+	if err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	// Cache both entities in memcache
+	g.FlushLocalCache()
+	if err := g.GetMulti([]*HasId{{Id: 1}, {Id: 2}}); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+	for _, key := range keys {
+		if _, err := memcache.Get(c, memkey(key)); err != nil {
+			t.Fatalf("Expected %v in memcache - %v", key, err)
+		}
+	}
+
+	if err := g.RunInTransactionXG(func(tg *Goon) error {
+		if _, err := tg.Put(&HasId{Id: 1, Name: "changed"}); err != nil {
+			return err
+		}
+		// Memcache is only invalidated on commit
+		if _, err := memcache.Get(c, memkey(keys[0])); err != nil {
+			t.Errorf("Expected %v to stay in memcache until the commit - %v", keys[0], err)
+		}
+		return tg.Delete(keys[1])
+	}); err != nil {
+		t.Fatalf("Unexpected error on RunInTransaction - %v", err)
+	}
+	for _, key := range keys {
+		if _, err := memcache.Get(c, memkey(key)); err != memcache.ErrCacheMiss {
+			t.Errorf("Expected %v to be deleted from memcache, got %v", key, err)
+		}
+	}
+
+	// Another request sees the committed changes
+	hids := []*HasId{{Id: 1}, {Id: 2}}
+	if err := FromContext(c).GetMulti(hids); !NotFound(err, 1) {
+		t.Fatalf("Expected the second entity to be deleted, got %v", err)
+	}
+	if hids[0].Name != "changed" {
+		t.Errorf("Expected the changed entity, got %v", hids[0].Name)
+	}
+}
+
+func TestIteratorCache(t *testing.T) {
+	c, closer := newConsistentContext(t)
+	defer closer()
+	g := FromContext(c)
+
+	items := make([]*HasId, iteratorCacheBatch+50)
+	for i := range items {
+		items[i] = &HasId{Id: int64(i + 1), Name: fmt.Sprint(i + 1)}
+	}
+	if _, err := g.PutMulti(items); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+	memcache.Flush(c)
+
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+	iterate := func(q *datastore.Query) int {
+		n := 0
+		var hid HasId // reused for every result
+		for it := g.Run(q); ; n++ {
+			if _, err := it.Next(&hid); err == datastore.Done {
+				return n
+			} else if err != nil {
+				t.Fatalf("Unexpected error on Next - %v", err)
+			}
+		}
+	}
+
+	// Keys-only and projection results are never cached
+	for _, q := range []*datastore.Query{
+		datastore.NewQuery("HasId").KeysOnly(),
+		datastore.NewQuery("HasId").Project("Name"),
+	} {
+		if n := iterate(q); n != len(items) {
+			t.Fatalf("Expected %v results, got %v", len(items), n)
+		}
+	}
+	if n := rec.count("memcache.Set"); n != 0 {
+		t.Errorf("Expected no memcache Sets for partial results, got %v", n)
+	}
+	if len(g.cache) != 0 {
+		t.Errorf("Expected nothing to be cached locally, got %v entries", len(g.cache))
+	}
+
+	// Complete results are cached in batches
+	if n := iterate(datastore.NewQuery("HasId").Order("__key__")); n != len(items) {
+		t.Fatalf("Expected %v results, got %v", len(items), n)
+	}
+	if n := rec.count("memcache.Set"); n != 2 {
+		t.Errorf("Expected 2 memcache Sets, got %v", n)
+	}
+	g.FlushLocalCache()
+	rec.reset()
+	hids := []*HasId{{Id: 1}, {Id: int64(len(items))}}
+	if err := g.GetMulti(hids); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+	if hids[0].Name != "1" || hids[1].Name != fmt.Sprint(len(items)) {
+		t.Errorf("Expected the cached entities to be distinct copies, got %+v, %+v", hids[0], hids[1])
+	}
+	if n := rec.count("datastore_v3.Get"); n != 0 {
+		t.Errorf("Expected the entities to be served from memcache, got %v datastore Gets", n)
+	}
+}
+
+func TestIterateKindGetError(t *testing.T) {
+	c, closer := newConsistentContext(t)
+	defer closer()
+	g := FromContext(c)
+
+	if _, err := g.PutMulti([]*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+	memcache.Flush(c)
+
+	getErr := errors.New("datastore is down")
+	g.Context = appengine.WithAPICallFunc(c, func(ctx context.Context, service, method string, in, out proto.Message) error {
+		if service == "datastore_v3" && method == "Get" {
+			return getErr
+		}
+		return appengine.APICall(ctx, service, method, in, out)
+	})
+	g.ErrorHandler = func(context.Context, error) {}
+
+	it := g.IterateKind("HasId", HasId{}, 10)
+	for i := 0; i < 3; i++ {
+		hid := &HasId{}
+		if _, err := it.Next(hid); err != getErr {
+			t.Fatalf("Expected %v, got %v and %+v", getErr, err, hid)
+		}
+	}
+}
+
+func TestGetAllProjection(t *testing.T) {
+	c, closer := newConsistentContext(t)
+	defer closer()
+	g := FromContext(c)
+
+	if _, err := g.PutMulti([]*Article{{Id: 1, Title: "First", Author: "ann", Body: "text"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+	memcache.Flush(c)
+
+	rec := &rpcRecorder{}
+	g.Context = rec.wrap(c)
+	q := datastore.NewQuery("Article").Project("Title", "Author")
+	var articles []Article
+	if _, err := g.GetAll(q, &articles); err != nil {
+		t.Fatalf("Unexpected error on GetAll - %v", err)
+	}
+	if _, _, err := g.GetAllFromCursor(q, datastore.Cursor{}, &articles); err != nil {
+		t.Fatalf("Unexpected error on GetAllFromCursor - %v", err)
+	}
+	if len(articles) != 2 || articles[0].Title != "First" || articles[0].Body != "" {
+		t.Fatalf("Expected 2 projected results, got %+v", articles)
+	}
+	if n := rec.count("memcache.Set"); n != 0 {
+		t.Errorf("Expected no memcache Sets, got %v", n)
+	}
+	if len(g.cache) != 0 {
+		t.Errorf("Expected nothing to be cached locally, got %v entries", len(g.cache))
+	}
+
+	// A Get loads the whole entity
+	article := &Article{Id: 1}
+	if err := g.Get(article); err != nil {
+		t.Fatalf("Unexpected error on Get - %v", err)
+	}
+	if article.Body != "text" {
+		t.Errorf("Expected the full entity, got %+v", article)
+	}
+}
+
+func TestWriteThroughExpired(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+	layer := &mapCacheLayer{items: make(map[string][]byte)}
+	g := FromContext(c)
+	g.WriteThrough = true
+	g.CacheLayer = layer
+
+	// Cache a copy that doesn't expire
+	src := &Expiring{Id: 1}
+	if _, err := g.Put(src); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	mk := memkey(g.Key(src))
+	if _, err := memcache.Get(c, mk); err != nil {
+		t.Fatalf("Expected the entity in memcache - %v", err)
+	}
+	if _, ok := layer.items[mk]; !ok {
+		t.Fatalf("Expected the entity in the layer")
+	}
+
+	// Once it is put expired, neither cache may serve the old copy
+	src.ExpiresAt = time.Now().Add(-time.Second)
+	if _, err := g.Put(src); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if _, err := memcache.Get(c, mk); err != memcache.ErrCacheMiss {
+		t.Errorf("Expected the old copy to be deleted from memcache, got %v", err)
+	}
+	if _, ok := layer.items[mk]; ok {
+		t.Errorf("Expected the old copy to be evicted from the layer")
+	}
+}
+
+func TestCacheLayerOtherInstance(t *testing.T) {
+	c, closer, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer closer()
+
+	// Two instances, each with a layer of its own
+	layers := []*mapCacheLayer{{items: make(map[string][]byte)}, {items: make(map[string][]byte)}}
+	request := func(instance int) *Goon {
+		g := FromContext(c)
+		g.CacheLayer = layers[instance]
+		g.MemcacheExpiration = time.Minute
+		return g
+	}
+	get := func(instance int) string {
+		hid := &HasId{Id: 1}
+		if err := request(instance).Get(hid); err != nil {
+			t.Fatalf("Unexpected error on Get - %v", err)
+		}
+		return hid.Name
+	}
+
+	if _, err := request(0).Put(&HasId{Id: 1, Name: "one"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if name := get(0); name != "one" {
+		t.Fatalf("Expected one, got %v", name)
+	}
+	mk := memkey(request(0).Key(&HasId{Id: 1}))
+	if exp := layers[0].expires[mk]; !exp.Equal(layers[0].now.Add(time.Minute)) {
+		t.Errorf("Expected the layer entry to expire with MemcacheExpiration, got %v", exp)
+	}
+
+	// The second instance changes the entity, which only evicts its own layer
+	if _, err := request(1).Put(&HasId{Id: 1, Name: "changed"}); err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if name := get(1); name != "changed" {
+		t.Errorf("Expected the second instance to see the change, got %v", name)
+	}
+	if name := get(0); name != "one" {
+		t.Errorf("Expected the first instance to serve its cached copy, got %v", name)
+	}
+
+	// Until the entry expires
+	layers[0].now = layers[0].now.Add(time.Minute)
+	if name := get(0); name != "changed" {
+		t.Errorf("Expected the first instance to see the change after expiration, got %v", name)
+	}
+}
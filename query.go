@@ -17,24 +17,43 @@
 package goon
 
 import (
+	"bytes"
 	"fmt"
 	"reflect"
 
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 )
 
 // Count returns the number of results for the query.
 func (g *Goon) Count(q *datastore.Query) (int, error) {
-	return q.Count(g.Context)
+	g.fakeDelay()
+	n, err := q.Count(g.rpcContext("datastore.Count"))
+	if err != nil {
+		g.error(err)
+	}
+	return n, err
+}
+
+// GetKeys runs q as a keys-only query and returns the keys of the results.
+// No entities are loaded or cached.
+func (g *Goon) GetKeys(q *datastore.Query) ([]*datastore.Key, error) {
+	g.fakeDelay()
+	keys, err := q.KeysOnly().GetAll(g.rpcContext("datastore.GetAll"), nil)
+	if err != nil {
+		g.error(err)
+		return nil, err
+	}
+	return keys, nil
 }
 
 // GetAll runs the query and returns all the keys that match the query, as well
 // as appending the values to dst, setting the goon key fields of dst, and
-// caching the returned data in local memory.
+// caching the returned data in local memory and memcache.
 //
 // For "keys-only" queries dst can be nil, however if it is not, then GetAll
 // appends zero value structs to dst, only setting the goon key fields.
-// No data is cached with "keys-only" queries.
+// No data is cached with "keys-only" or projection queries.
 //
 // See: https://developers.google.com/appengine/docs/go/datastore/reference#Query.GetAll
 func (g *Goon) GetAll(q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
@@ -54,7 +73,8 @@ func (g *Goon) GetAll(q *datastore.Query, dst interface{}) ([]*datastore.Key, er
 		vLenBefore = v.Len()
 	}
 
-	keys, err := q.GetAll(g.Context, dst)
+	g.fakeDelay()
+	keys, err := q.GetAll(g.rpcContext("datastore.GetAll"), dst)
 	if err != nil {
 		g.error(err)
 		return nil, err
@@ -64,7 +84,7 @@ func (g *Goon) GetAll(q *datastore.Query, dst interface{}) ([]*datastore.Key, er
 	}
 
 	keysOnly := ((v.Len() - vLenBefore) != len(keys))
-	updateCache := !g.inTransaction && !keysOnly
+	updateCache := !g.inTransaction && !keysOnly && !partialQuery(q)
 
 	// If this is a keys-only query, we need to fill the slice with zero value elements
 	if keysOnly {
@@ -89,11 +109,7 @@ func (g *Goon) GetAll(q *datastore.Query, dst interface{}) ([]*datastore.Key, er
 		}
 	}
 
-	if updateCache {
-		g.cacheLock.Lock()
-		defer g.cacheLock.Unlock()
-	}
-
+	var toCache []interface{}
 	for i, k := range keys {
 		var e interface{}
 		vi := v.Index(vLenBefore + i)
@@ -108,50 +124,270 @@ func (g *Goon) GetAll(q *datastore.Query, dst interface{}) ([]*datastore.Key, er
 		}
 
 		if updateCache {
-			// Cache lock is handled before the for loop
-			g.cache[memkey(k)] = e
+			toCache = append(toCache, e)
+		}
+	}
+
+	if len(toCache) > 0 {
+		if err := g.putMemcache(toCache, bytes.Repeat([]byte{1}, len(toCache))); err != nil {
+			g.error(err)
+			// since putMemcache() gives no guarantee it will actually store the data in memcache
+			// we log and swallow this error
 		}
 	}
 
 	return keys, nil
 }
 
+// GetProjection runs the projection query q, e.g. one built with
+// q.Project("Name"), appending the results to dst and setting their goon key
+// fields. It returns the keys of the results. dst must be a pointer to a []S
+// or []*S, where S is usually a struct with only the projected fields.
+//
+// Unlike GetAll, nothing is cached, since the results are incomplete entities
+// that must not be served by a later Get.
+func (g *Goon) GetProjection(q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return nil, fmt.Errorf("goon: Expected dst to be a pointer to a slice, got instead: %v", v.Kind())
+	}
+	v = v.Elem()
+	vLenBefore := v.Len()
+
+	g.fakeDelay()
+	keys, err := q.GetAll(g.rpcContext("datastore.GetAll"), dst)
+	if err != nil {
+		g.error(err)
+		return nil, err
+	}
+	for i, k := range keys {
+		if err := g.setStructKey(elemInterface(v.Index(vLenBefore+i)), k); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// GetAllFromCursor is like GetAll, but starts the query at the cursor start,
+// and also returns the cursor at which the results ended. Passing that cursor
+// to the next call continues the query where this one stopped. A zero start
+// cursor starts at the beginning. Use a query limit as the page size.
+//
+// dst must be a pointer to a []S or []*S, and q must not be keys-only. The
+// results of projection queries aren't cached.
+func (g *Goon) GetAllFromCursor(q *datastore.Query, start datastore.Cursor, dst interface{}) ([]*datastore.Key, datastore.Cursor, error) {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return nil, datastore.Cursor{}, fmt.Errorf("goon: Expected dst to be a pointer to a slice, got instead: %v", v.Kind())
+	}
+	v = v.Elem()
+	elemType := v.Type().Elem()
+	ptr := elemType.Kind() == reflect.Ptr
+	if ptr {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		return nil, datastore.Cursor{}, fmt.Errorf("goon: Expected struct, got instead: %v", elemType.Kind())
+	}
+
+	if start.String() != "" {
+		q = q.Start(start)
+	}
+	g.fakeDelay()
+	it := q.Run(g.rpcContext("datastore.Run"))
+	var keys []*datastore.Key
+	var toCache []interface{}
+	for {
+		ev := reflect.New(elemType)
+		k, err := it.Next(ev.Interface())
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			g.error(err)
+			return nil, datastore.Cursor{}, err
+		}
+		if err := g.setStructKey(ev.Interface(), k); err != nil {
+			return nil, datastore.Cursor{}, err
+		}
+		keys = append(keys, k)
+		toCache = append(toCache, ev.Interface())
+		if !ptr {
+			ev = ev.Elem()
+		}
+		v.Set(reflect.Append(v, ev))
+	}
+	end, err := it.Cursor()
+	if err != nil {
+		g.error(err)
+		return nil, datastore.Cursor{}, err
+	}
+
+	if len(toCache) > 0 && !g.inTransaction && !partialQuery(q) {
+		if err := g.putMemcache(toCache, bytes.Repeat([]byte{1}, len(toCache))); err != nil {
+			g.error(err)
+			// since putMemcache() gives no guarantee it will actually store the data in memcache
+			// we log and swallow this error
+		}
+	}
+
+	return keys, end, nil
+}
+
+// DeleteQuery deletes every entity matching q, and returns how many were
+// deleted. q is run as a keys-only query, and the keys are deleted with
+// DeleteMulti as they come in, a batch at a time, so arbitrarily many
+// entities can be deleted without holding all their keys in memory. If an
+// error occurs, the returned count includes the entities deleted before it.
+func (g *Goon) DeleteQuery(q *datastore.Query) (int, error) {
+	limit := batchLimit(g.DeleteMultiLimit, deleteMultiLimit)
+	g.fakeDelay()
+	it := q.KeysOnly().Run(g.rpcContext("datastore.Run"))
+	deleted := 0
+	keys := make([]*datastore.Key, 0, limit)
+	for {
+		if err := g.Context.Err(); err != nil {
+			return deleted, err
+		}
+		k, err := it.Next(nil)
+		if err != nil && err != datastore.Done {
+			g.error(err)
+			return deleted, err
+		}
+		if k != nil {
+			keys = append(keys, k)
+		}
+		if len(keys) == limit || (err == datastore.Done && len(keys) > 0) {
+			if err := g.DeleteMulti(keys); err != nil {
+				return deleted, err
+			}
+			deleted += len(keys)
+			keys = keys[:0]
+		}
+		if err == datastore.Done {
+			return deleted, nil
+		}
+	}
+}
+
+// Migrate loads every entity matching q into a new struct pointer from
+// newFunc, applies transform to it, and saves it back. The entities are saved
+// with PutMulti, a batch at a time, so the caches are kept up to date. It
+// returns how many entities were migrated. If transform or a save fails,
+// Migrate stops, and the returned count includes the entities saved before.
+//
+// q must not be keys-only. The entities aren't migrated in a transaction, so
+// concurrent updates of them may be lost; transform should be idempotent, so
+// that a failed migration can simply be run again.
+func (g *Goon) Migrate(q *datastore.Query, transform func(interface{}) error, newFunc func() interface{}) (int, error) {
+	limit := batchLimit(g.PutMultiLimit, putMultiLimit)
+	g.fakeDelay()
+	it := q.Run(g.rpcContext("datastore.Run"))
+	migrated := 0
+	batch := make([]interface{}, 0, limit)
+	for {
+		if err := g.Context.Err(); err != nil {
+			return migrated, err
+		}
+		dst := newFunc()
+		k, err := it.Next(dst)
+		if err != nil && err != datastore.Done {
+			g.error(err)
+			return migrated, err
+		}
+		if err == nil {
+			if err := g.setStructKey(dst, k); err != nil {
+				return migrated, err
+			}
+			if err := transform(dst); err != nil {
+				return migrated, err
+			}
+			batch = append(batch, dst)
+		}
+		if len(batch) == limit || (err == datastore.Done && len(batch) > 0) {
+			if _, err := g.PutMulti(batch); err != nil {
+				return migrated, err
+			}
+			migrated += len(batch)
+			batch = batch[:0]
+		}
+		if err == datastore.Done {
+			return migrated, nil
+		}
+	}
+}
+
+// partialQuery reports whether the results of q are incomplete entities,
+// i.e. whether q is keys-only or a projection query. Such results must never
+// be cached. The datastore package doesn't export this, so it is read with
+// reflection; if that fails, q is assumed to be partial.
+func partialQuery(q *datastore.Query) bool {
+	v := reflect.ValueOf(q).Elem()
+	keysOnly, projection := v.FieldByName("keysOnly"), v.FieldByName("projection")
+	if keysOnly.Kind() != reflect.Bool || projection.Kind() != reflect.Slice {
+		return true
+	}
+	return keysOnly.Bool() || projection.Len() > 0
+}
+
+// iteratorCacheBatch is the number of results Iterator.Next stores in
+// memcache at once.
+const iteratorCacheBatch = 100
+
 // Run runs the query.
 func (g *Goon) Run(q *datastore.Query) *Iterator {
+	g.fakeDelay()
 	return &Iterator{
-		g: g,
-		i: q.Run(g.Context),
+		g:     g,
+		i:     q.Run(g.rpcContext("datastore.Run")),
+		cache: !partialQuery(q),
 	}
 }
 
 // Iterator is the result of running a query.
 type Iterator struct {
-	g *Goon
-	i *datastore.Iterator
+	g       *Goon
+	i       *datastore.Iterator
+	cache   bool          // whether the results are complete entities
+	pending []interface{} // copies of results not yet stored in memcache
 }
 
-// Cursor returns a cursor for the iterator's current location.
+// Cursor returns a cursor for the iterator's current location. It also
+// stores the results returned so far in memcache.
 func (t *Iterator) Cursor() (datastore.Cursor, error) {
+	t.flush()
 	return t.i.Cursor()
 }
 
+// flush stores the pending results in memcache.
+func (t *Iterator) flush() {
+	if len(t.pending) == 0 {
+		return
+	}
+	if err := t.g.putMemcache(t.pending, bytes.Repeat([]byte{1}, len(t.pending))); err != nil {
+		t.g.error(err)
+		// since putMemcache() gives no guarantee it will actually store the data in memcache
+		// we log and swallow this error
+	}
+	t.pending = nil
+}
+
 // Next returns the entity of the next result. When there are no more results,
 // datastore.Done is returned as the error. If dst is null (for a keys-only
 // query), nil is returned as the entity.
 //
 // If the query is not keys only and dst is non-nil, it also loads the entity
 // stored for that key into the struct pointer dst, with the same semantics
-// and possible errors as for the Get function. This result is cached in memory.
-//
-// If the query is keys only, dst must be passed as nil. Otherwise the cache
-// will be populated with empty entities since there is no way to detect the
-// case of a keys-only query.
+// and possible errors as for the Get function. This result is cached in memory
+// and in memcache, unless the query is keys only or a projection query. To
+// save RPCs, results are stored in memcache in batches, when enough of them
+// were returned, at the end of the results, and when Cursor is called.
 //
 // Refer to appengine/datastore.Iterator.Next:
 // https://developers.google.com/appengine/docs/go/datastore/reference#Iterator.Next
 func (t *Iterator) Next(dst interface{}) (*datastore.Key, error) {
 	k, err := t.i.Next(dst)
 	if err != nil {
+		t.flush()
 		return k, err
 	}
 
@@ -159,12 +395,138 @@ func (t *Iterator) Next(dst interface{}) (*datastore.Key, error) {
 		// Update the struct to have correct key info
 		t.g.setStructKey(dst, k)
 
-		if !t.g.inTransaction {
-			t.g.cacheLock.Lock()
-			t.g.cache[memkey(k)] = dst
-			t.g.cacheLock.Unlock()
+		if t.cache && !t.g.inTransaction {
+			// dst may be reused for the next result, so cache a copy
+			dv := reflect.Indirect(reflect.ValueOf(dst))
+			cp := reflect.New(dv.Type())
+			cp.Elem().Set(dv)
+			t.pending = append(t.pending, cp.Interface())
+			if len(t.pending) >= iteratorCacheBatch {
+				t.flush()
+			}
 		}
 	}
 
 	return k, err
 }
+
+// IterateKind returns an iterator over every entity of the given kind.
+//
+// Keys are fetched batchSize at a time with a keys-only query and then loaded
+// with GetMulti, so every entity is served from, and populates, the local
+// cache and memcache. prototype must be a struct or pointer to struct of the
+// type to load the entities into. This is meant for maintenance jobs that need
+// to visit every entity of a kind exactly once.
+func (g *Goon) IterateKind(kind string, prototype interface{}, batchSize int) *KindIterator {
+	if batchSize <= 0 {
+		batchSize = batchLimit(g.GetMultiLimit, getMultiLimit)
+	}
+	return &KindIterator{
+		g:         g,
+		kind:      kind,
+		elemType:  reflect.Indirect(reflect.ValueOf(prototype)).Type(),
+		batchSize: batchSize,
+	}
+}
+
+// KindIterator is the result of IterateKind.
+type KindIterator struct {
+	g         *Goon
+	kind      string
+	elemType  reflect.Type
+	batchSize int
+	cursor    *datastore.Cursor
+	done      bool
+	err       error
+
+	keys   []*datastore.Key
+	values []interface{}
+	errs   appengine.MultiError
+	pos    int
+}
+
+// Next loads the next entity into dst and returns its key. dst must be a
+// pointer to a struct of the same type as the prototype given to IterateKind.
+// When there are no more entities, datastore.Done is returned as the error.
+//
+// Entities that are deleted between the keys-only query and the batch Get are
+// skipped.
+func (t *KindIterator) Next(dst interface{}) (*datastore.Key, error) {
+	for {
+		for t.pos < len(t.keys) {
+			i := t.pos
+			t.pos++
+			if t.errs != nil && t.errs[i] != nil {
+				if t.errs[i] == datastore.ErrNoSuchEntity {
+					continue
+				}
+				return t.keys[i], t.errs[i]
+			}
+			v := reflect.ValueOf(dst)
+			if v.Kind() != reflect.Ptr || v.Elem().Type() != t.elemType {
+				return nil, fmt.Errorf("goon: Expected dst to be a pointer to %v, got instead: %v", t.elemType, v.Type())
+			}
+			v.Elem().Set(reflect.ValueOf(t.values[i]).Elem())
+			return t.keys[i], nil
+		}
+		if t.err != nil {
+			return nil, t.err
+		}
+		if t.done {
+			return nil, datastore.Done
+		}
+		t.err = t.fetch()
+	}
+}
+
+// fetch loads the next batch of entities.
+func (t *KindIterator) fetch() error {
+	q := datastore.NewQuery(t.kind).KeysOnly().Limit(t.batchSize)
+	if t.cursor != nil {
+		q = q.Start(*t.cursor)
+	}
+	it := t.g.Run(q)
+	var keys []*datastore.Key
+	for {
+		k, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			t.g.error(err)
+			return err
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) < t.batchSize {
+		t.done = true
+	} else {
+		cursor, err := it.Cursor()
+		if err != nil {
+			t.g.error(err)
+			return err
+		}
+		t.cursor = &cursor
+	}
+
+	values := make([]interface{}, len(keys))
+	for i, k := range keys {
+		values[i] = reflect.New(t.elemType).Interface()
+		if err := t.g.setStructKey(values[i], k); err != nil {
+			return err
+		}
+	}
+	var errs appengine.MultiError
+	if len(keys) > 0 {
+		if err := t.g.GetMulti(values); err != nil {
+			merr, ok := err.(appengine.MultiError)
+			if !ok {
+				// Nothing was loaded, so don't return any of this batch
+				t.keys, t.values, t.errs, t.pos = nil, nil, nil, 0
+				return err
+			}
+			errs = merr
+		}
+	}
+	t.keys, t.values, t.errs, t.pos = keys, values, errs, 0
+	return nil
+}